@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+)
+
+// TargetStatus is the state of the connections to one target reported by
+// the admin listener.
+type TargetStatus struct {
+	Target     string
+	Connecting int
+	Idle       int
+	Running    int
+	Available  int
+	Total      int
+	Circuit    string
+	Failures   int
+}
+
+// listenAdmin serves metrics, the client status and health probes on
+// address. /healthz answers as long as the client runs while /readyz fails
+// until a connection to a target is established.
+func (c *Client) listenAdmin(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.metrics.registry)
+	mux.HandleFunc("/status", c.status)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", c.ready)
+
+	c.admin = &http.Server{Handler: mux}
+
+	log.Printf("Admin listening on %s", address)
+	go c.admin.Serve(listener)
+
+	return nil
+}
+
+func (c *Client) getStatus() (targets []*TargetStatus) {
+	targets = []*TargetStatus{}
+	for _, pool := range c.getPools() {
+		ps := pool.getSize()
+		circuit, failures := pool.getCircuit()
+		targets = append(targets, &TargetStatus{
+			Target:     pool.target,
+			Connecting: ps.connecting,
+			Idle:       ps.idle,
+			Running:    ps.running,
+			Available:  ps.available,
+			Total:      ps.total,
+			Circuit:    circuit.String(),
+			Failures:   failures,
+		})
+	}
+	return
+}
+
+func (c *Client) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(c.getStatus()); err != nil {
+		log.Printf("Unable to write status : %s", err)
+	}
+}
+
+func (c *Client) ready(w http.ResponseWriter, r *http.Request) {
+	for _, target := range c.getStatus() {
+		if target.Idle+target.Running > 0 {
+			w.Write([]byte("ok"))
+			return
+		}
+	}
+	http.Error(w, "no established connection", http.StatusServiceUnavailable)
+}
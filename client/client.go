@@ -2,38 +2,227 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
 type Client struct {
 	Config *Config
 
-	client *http.Client
-	dialer *websocket.Dialer
-	pools  map[string]*Pool
+	lock    sync.RWMutex
+	ctx     context.Context
+	client  *http.Client
+	dialer  *websocket.Dialer
+	pools   map[string]*Pool
+	metrics *clientMetrics
+	admin   *http.Server
 }
 
 func NewClient(config *Config) (c *Client) {
+	rand.Seed(time.Now().UnixNano())
+
 	c = new(Client)
 	c.Config = config
-	c.client = &http.Client{}
-	c.dialer = &websocket.Dialer{}
+	c.client = &http.Client{CheckRedirect: c.checkRedirect}
+	c.dialer = newDialer(config)
 	c.pools = make(map[string]*Pool)
+	c.metrics = newClientMetrics(c)
 	return
 }
 
+func newDialer(config *Config) (dialer *websocket.Dialer) {
+	dialer = &websocket.Dialer{}
+	if config.TLS != nil {
+		dialer.TLSClientConfig = config.TLS.config
+	}
+	return
+}
+
+var errForbiddenRedirect = errors.New("Forbidden redirect")
+
+// checkRedirect applies the rules and destinations to every redirect
+// followed, not only to the proxied request.
+func (c *Client) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+
+	config := c.getConfig()
+	if err := wsp.CheckRules(req, config.Whitelist, config.Blacklist); err != nil {
+		return fmt.Errorf("%w : %s", errForbiddenRedirect, err)
+	}
+	destinations, _ := wsp.ParseDestinations(config.Destinations)
+	if len(destinations) > 0 && !wsp.MatchDestinations(destinations, req.URL) {
+		return fmt.Errorf("%w : %s is not a destination of this client", errForbiddenRedirect, req.URL.Host)
+	}
+	return nil
+}
+
+func (c *Client) getConfig() *Config {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.Config
+}
+
+func (c *Client) getDialer() *websocket.Dialer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.dialer
+}
+
+func (c *Client) dial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	address := wsp.DialAddress(u)
+	if wsp.IsTLS(u) {
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
 func (c *Client) Start(ctx context.Context) {
+	c.lock.Lock()
+	c.ctx = ctx
+	var pools []*Pool
 	for _, target := range c.Config.Targets {
+		if _, ok := c.pools[target]; ok {
+			continue
+		}
 		pool := NewPool(c, target, c.Config.SecretKey)
 		c.pools[target] = pool
+		pools = append(pools, pool)
+	}
+	c.lock.Unlock()
+
+	for _, pool := range pools {
+		go pool.Start(ctx)
+	}
+
+	config := c.getConfig()
+	if config.AdminListen != "" {
+		if err := c.listenAdmin(config.AdminListen); err != nil {
+			log.Printf("Unable to start admin listener on %s : %s", config.AdminListen, err)
+		}
+	}
+}
+
+// Reload applies config to the running client. Pools are started for added
+// targets and drained for removed ones while the others are left untouched.
+// Established connections keep the ID, labels, destinations and capabilities
+// they advertised until they reconnect, and moving the admin listener
+// requires a restart.
+func (c *Client) Reload(config *Config) {
+	c.lock.Lock()
+	previous := c.Config
+	if config.generatedID {
+		config.ID = previous.ID
+	}
+	c.Config = config
+	c.dialer = newDialer(config)
+
+	targets := make(map[string]bool)
+	var added, kept []*Pool
+	for _, target := range config.Targets {
+		targets[target] = true
+		if pool, ok := c.pools[target]; ok {
+			kept = append(kept, pool)
+			continue
+		}
+		pool := NewPool(c, target, config.SecretKey)
+		c.pools[target] = pool
+		added = append(added, pool)
+	}
+
+	var removed []*Pool
+	for target, pool := range c.pools {
+		if !targets[target] {
+			delete(c.pools, target)
+			removed = append(removed, pool)
+		}
+	}
+	ctx := c.ctx
+	c.lock.Unlock()
+
+	// Pools lock themselves before reading the client configuration, so they
+	// are only updated once the client lock is released.
+	for _, pool := range kept {
+		pool.setSecretKey(config.SecretKey)
+	}
+	for _, pool := range removed {
+		log.Printf("Draining connections to removed target %s", pool.target)
+		pool.Drain()
+	}
+	for _, pool := range added {
+		log.Printf("Connecting to added target %s", pool.target)
 		go pool.Start(ctx)
 	}
+
+	if config.AdminListen != previous.AdminListen {
+		log.Printf("Admin listener changes require a restart")
+	}
+	log.Printf("Configuration reloaded")
+}
+
+// getPools returns the pools in the order of the configured targets.
+func (c *Client) getPools() (pools []*Pool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, target := range c.Config.Targets {
+		if pool, ok := c.pools[target]; ok {
+			pools = append(pools, pool)
+		}
+	}
+	return
 }
 
+// Shutdown drains every pool, waits up to ShutdownTimeout for the requests
+// in flight to complete and closes the remaining connections.
 func (c *Client) Shutdown() {
-	for _, pool := range c.pools {
+	pools := c.getPools()
+	for _, pool := range pools {
+		pool.Drain()
+	}
+
+	timeout := time.After(time.Duration(c.getConfig().ShutdownTimeout) * time.Millisecond)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+L:
+	for {
+		total := 0
+		for _, pool := range pools {
+			total += pool.getSize().total
+		}
+		if total == 0 {
+			break
+		}
+
+		select {
+		case <-timeout:
+			log.Printf("Shutdown timeout expired with %d connections left", total)
+			break L
+		case <-ticker.C:
+		}
+	}
+
+	for _, pool := range pools {
 		pool.Shutdown()
 	}
+	if c.admin != nil {
+		c.admin.Close()
+	}
 }
@@ -1,8 +1,12 @@
 package client
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
 	"os"
 
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 	uuid "github.com/nu7hatch/gouuid"
 	"gopkg.in/yaml.v2"
 )
@@ -12,7 +16,76 @@ type Config struct {
 	Targets      []string
 	PoolIdleSize int
 	PoolMaxSize  int
+	MaxStreams   int
 	SecretKey    string
+	Token        string
+	Destinations []string
+	AllowTunnels bool
+	Labels       map[string]string
+
+	// Whitelist and Blacklist filter the requests served. Tunnels are matched
+	// as CONNECT tcp://host:port.
+	Whitelist []*wsp.Rule
+	Blacklist []*wsp.Rule
+
+	Backoff Backoff
+	TLS     *TLS
+
+	// ShutdownTimeout is how long, in milliseconds, requests in flight are
+	// given to complete on shutdown.
+	ShutdownTimeout int
+
+	// AdminListen is the address of the local admin listener serving metrics
+	// and health probes. It is disabled when empty.
+	AdminListen string
+
+	generatedID bool
+}
+
+// Backoff paces reconnections to a target once connecting to it failed.
+// Delays are in milliseconds and grow by Factor after each failure, up to Max.
+// Jitter is the fraction of each delay that is randomized. After Threshold
+// consecutive failures the circuit opens and a single probe connection is
+// attempted per delay.
+type Backoff struct {
+	Min       int
+	Max       int
+	Factor    float64
+	Jitter    float64
+	Threshold int
+}
+
+// TLS configures how the client connects to wss:// targets. CA replaces the
+// system roots to verify the server, Cert and Key are presented to servers
+// requiring client certificates and ServerName overrides the name verified.
+type TLS struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+
+	config *tls.Config
+}
+
+func (t *TLS) Compile() (err error) {
+	t.config = &tls.Config{ServerName: t.ServerName}
+
+	if t.CA != "" {
+		t.config.RootCAs, err = wsp.LoadCertPool(t.CA)
+		if err != nil {
+			return fmt.Errorf("unable to load ca : %w", err)
+		}
+	}
+
+	if t.Cert != "" || t.Key != "" {
+		certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return fmt.Errorf("unable to load tls certificate : %w", err)
+		}
+		t.config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return
 }
 
 func NewConfig() (config *Config) {
@@ -26,6 +99,9 @@ func NewConfig() (config *Config) {
 	config.Targets = []string{"ws://127.0.0.1:8080/register"}
 	config.PoolIdleSize = 10
 	config.PoolMaxSize = 100
+	config.MaxStreams = 64
+	config.ShutdownTimeout = 30000
+	config.Backoff = Backoff{Min: 1000, Max: 60000, Factor: 2, Jitter: 0.2, Threshold: 5}
 	return
 }
 
@@ -37,10 +113,58 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		return
 	}
 
+	generatedID := config.ID
 	err = yaml.Unmarshal(bytes, config)
 	if err != nil {
 		return
 	}
+	config.generatedID = config.ID == generatedID
+
+	_, err = wsp.ParseDestinations(config.Destinations)
+	if err != nil {
+		return
+	}
+
+	err = wsp.ValidateLabels(config.Labels)
+	if err != nil {
+		return
+	}
+
+	err = wsp.CompileRules(config.Whitelist)
+	if err != nil {
+		return
+	}
+
+	err = wsp.CompileRules(config.Blacklist)
+	if err != nil {
+		return
+	}
+
+	if config.Backoff.Min <= 0 || config.Backoff.Max < config.Backoff.Min || config.Backoff.Factor < 1 {
+		err = fmt.Errorf("invalid backoff %d..%dms x%g", config.Backoff.Min, config.Backoff.Max, config.Backoff.Factor)
+		return
+	}
+	if config.Backoff.Jitter < 0 || config.Backoff.Jitter > 1 {
+		err = fmt.Errorf("invalid backoff jitter %g", config.Backoff.Jitter)
+		return
+	}
+	if config.Backoff.Threshold < 1 {
+		err = fmt.Errorf("invalid backoff threshold %d", config.Backoff.Threshold)
+		return
+	}
+
+	if config.TLS != nil {
+		if err = config.TLS.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.AdminListen != "" {
+		if _, err = net.ResolveTCPAddr("tcp", config.AdminListen); err != nil {
+			err = fmt.Errorf("invalid admin listen address %q : %w", config.AdminListen, err)
+			return
+		}
+	}
 
 	return
 }
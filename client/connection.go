@@ -1,18 +1,25 @@
 package client
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
+const handshakeTimeout = 10 * time.Second
+
 const (
 	CONNECTING = iota
 	IDLE
@@ -20,9 +27,13 @@ const (
 )
 
 type Connection struct {
-	pool   *Pool
-	ws     *websocket.Conn
-	status int
+	lock     sync.Mutex
+	pool     *Pool
+	ws       *websocket.Conn
+	mux      *wsp.Mux
+	status   int
+	streams  int
+	draining bool
 }
 
 func NewConnection(pool *Pool) *Connection {
@@ -34,121 +45,379 @@ func NewConnection(pool *Pool) *Connection {
 
 func (connection *Connection) Connect(ctx context.Context) (err error) {
 	log.Printf("Connecting to %s", connection.pool.target)
-	connection.ws, _, err = connection.pool.client.dialer.DialContext(
-		ctx,
-		connection.pool.target,
-		http.Header{"X-SECRET-KEY": {connection.pool.secretKey}},
-	)
+
+	header := http.Header{"X-SECRET-KEY": {connection.pool.getSecretKey()}}
+	if token := connection.pool.client.getConfig().Token; token != "" {
+		header = http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	connection.ws, _, err = connection.pool.client.getDialer().DialContext(ctx, connection.pool.target, header)
 
 	if err != nil {
 		return err
 	}
 
+	connection.mux = wsp.NewMux(connection.ws, func(stream *wsp.Stream) {
+		connection.serveStream(ctx, stream)
+	})
+
 	log.Printf("Connected to %s", connection.pool.target)
 
-	greeting := fmt.Sprintf(
-		"%s_%d",
-		connection.pool.client.Config.ID,
-		connection.pool.client.Config.PoolIdleSize,
-	)
-	if err := connection.ws.WriteMessage(websocket.TextMessage, []byte(greeting)); err != nil {
+	if err := connection.handshake(); err != nil {
 		log.Println("greeting error :", err)
 		connection.Close()
 		return err
 	}
 
+	connection.lock.Lock()
+	connection.status = IDLE
+	draining := connection.draining
+	connection.lock.Unlock()
+
+	if draining {
+		connection.goAway()
+		return
+	}
+
 	go connection.serve(ctx)
 	return
 }
 
+func (connection *Connection) handshake() error {
+	config := connection.pool.client.getConfig()
+
+	greeting := wsp.NewGreeting(config.ID)
+	greeting.IdleSize = config.PoolIdleSize
+	greeting.MaxSize = config.PoolMaxSize
+	greeting.MaxStreams = config.MaxStreams
+	greeting.Capabilities = []string{wsp.CapabilityWebsocket}
+	if config.AllowTunnels {
+		greeting.Capabilities = append(greeting.Capabilities, wsp.CapabilityTunnel)
+	}
+	greeting.Destinations = config.Destinations
+	for key, value := range config.Labels {
+		greeting.Labels[key] = value
+	}
+
+	if err := connection.ws.WriteJSON(greeting); err != nil {
+		return err
+	}
+
+	connection.ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	reply := new(wsp.GreetingReply)
+	if err := connection.ws.ReadJSON(reply); err != nil {
+		return fmt.Errorf("unable to read greeting reply : %w", err)
+	}
+	connection.ws.SetReadDeadline(time.Time{})
+
+	if !reply.Accepted {
+		return fmt.Errorf("registration rejected : %s", reply.Reason)
+	}
+	if err := wsp.CheckVersion(reply.Version); err != nil {
+		return fmt.Errorf("registration rejected : %w", err)
+	}
+
+	return nil
+}
+
 func (connection *Connection) serve(ctx context.Context) {
 	defer connection.Close()
 
 	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
 		for {
-			time.Sleep(30 * time.Second)
+			select {
+			case <-connection.mux.Done():
+				return
+			case <-ticker.C:
+			}
+
 			err := connection.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second))
 			if err != nil {
 				connection.Close()
+				return
 			}
 		}
 	}()
 
-	for {
-		connection.status = IDLE
-		_, jsonRequest, err := connection.ws.ReadMessage()
-		if err != nil {
-			log.Println("Unable to read request", err)
-			break
-		}
+	if err := connection.mux.Serve(); err != nil {
+		log.Println("Unable to read request", err)
+	}
+}
 
-		connection.status = RUNNING
+func (connection *Connection) serveStream(ctx context.Context, stream *wsp.Stream) {
+	defer stream.Close()
 
-		go connection.pool.connector(ctx)
+	if !connection.begin(ctx) {
+		connection.error(stream, http.StatusServiceUnavailable, "Client is shutting down\n")
+		return
+	}
+	defer connection.end()
 
-		httpRequest := new(wsp.HTTPRequest)
-		err = json.Unmarshal(jsonRequest, httpRequest)
-		if err != nil {
-			connection.error(fmt.Sprintf("Unable to deserialize json http request : %s\n", err))
-			break
-		}
+	if stream.Flags()&wsp.FlagDial != 0 {
+		connection.serveDial(stream.Context(), stream)
+		return
+	}
 
-		req, err := wsp.UnserializeHTTPRequest(httpRequest)
-		if err != nil {
-			connection.error(fmt.Sprintf("Unable to deserialize http request : %v\n", err))
-			break
-		}
+	httpRequest := new(wsp.HTTPRequest)
+	err := json.Unmarshal(stream.Header(), httpRequest)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to deserialize json http request : %s\n", err))
+		return
+	}
 
-		log.Printf("[%s] %s", req.Method, req.URL.String())
+	req, err := wsp.UnserializeHTTPRequest(httpRequest)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to deserialize http request : %v\n", err))
+		return
+	}
 
-		_, bodyReader, err := connection.ws.NextReader()
-		if err != nil {
-			log.Printf("Unable to get response body reader : %v", err)
-			break
-		}
-		req.Body = io.NopCloser(bodyReader)
+	log.Printf("[%s] %s", req.Method, req.URL.String())
 
-		resp, err := connection.pool.client.client.Do(req)
-		if err != nil {
-			err = connection.error(fmt.Sprintf("Unable to execute request : %v\n", err))
-			if err != nil {
-				break
-			}
-			continue
-		}
+	requestCtx := stream.Context()
+	if httpRequest.Timeout != 0 {
+		var cancel context.CancelFunc
+		requestCtx, cancel = context.WithTimeout(requestCtx, httpRequest.Timeout)
+		defer cancel()
+	}
 
-		jsonResponse, err := json.Marshal(wsp.SerializeHTTPResponse(resp))
-		if err != nil {
-			err = connection.error(fmt.Sprintf("Unable to serialize response : %v\n", err))
-			if err != nil {
-				break
-			}
-			continue
-		}
+	req = req.WithContext(requestCtx)
+	req.Body = io.NopCloser(stream)
+	if req.ContentLength == 0 {
+		req.Body = http.NoBody
+	}
+
+	config := connection.pool.client.getConfig()
+	if err := wsp.CheckRules(req, config.Whitelist, config.Blacklist); err != nil {
+		connection.error(stream, http.StatusForbidden, fmt.Sprintf("Forbidden request : %v\n", err))
+		return
+	}
+	destinations, _ := wsp.ParseDestinations(config.Destinations)
+	if !wsp.MatchDestinations(destinations, req.URL) {
+		connection.error(stream, http.StatusForbidden, fmt.Sprintf("Forbidden request : %s is not an advertised destination\n", req.URL.Host))
+		return
+	}
 
-		err = connection.ws.WriteMessage(websocket.TextMessage, jsonResponse)
-		if err != nil {
-			log.Printf("Unable to write response : %v", err)
-			break
+	if stream.Flags()&wsp.FlagUpgrade != 0 {
+		connection.serveUpgrade(requestCtx, stream, req)
+		return
+	}
+
+	start := time.Now()
+	resp, err := connection.pool.client.client.Do(req)
+	connection.pool.client.metrics.duration.Observe(time.Since(start).Seconds(), connection.pool.target, statusClass(resp, err))
+	if err != nil {
+		statusCode := 527
+		if requestCtx.Err() == context.DeadlineExceeded {
+			statusCode = http.StatusGatewayTimeout
+		} else if errors.Is(err, errForbiddenRedirect) {
+			statusCode = http.StatusForbidden
 		}
+		connection.error(stream, statusCode, fmt.Sprintf("Unable to execute request : %v\n", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	jsonResponse, err := json.Marshal(wsp.SerializeHTTPResponse(resp))
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to serialize response : %v\n", err))
+		return
+	}
+
+	if err := stream.Reply(jsonResponse); err != nil {
+		log.Printf("Unable to write response : %v", err)
+		return
+	}
+
+	if _, err := io.Copy(stream, resp.Body); err != nil {
+		log.Printf("Unable to pipe response body : %v", err)
+		return
+	}
+	stream.CloseWrite()
+}
+
+// serveUpgrade replays the websocket handshake to the destination and, once
+// it switched protocols, pipes raw bytes between it and the stream.
+func (connection *Connection) serveUpgrade(ctx context.Context, stream *wsp.Stream, req *http.Request) {
+	conn, err := connection.pool.client.dial(ctx, req.URL)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to dial %s : %v\n", req.URL.Host, err))
+		return
+	}
+	defer conn.Close()
+
+	if err := req.Write(conn); err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to write upgrade request : %v\n", err))
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to read upgrade response : %v\n", err))
+		return
+	}
+	defer resp.Body.Close()
+
+	jsonResponse, err := json.Marshal(wsp.SerializeHTTPResponse(resp))
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to serialize response : %v\n", err))
+		return
+	}
+
+	if err := stream.Reply(jsonResponse); err != nil {
+		log.Printf("Unable to write response : %v", err)
+		return
+	}
 
-		bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
-		if err != nil {
-			log.Printf("Unable to get response body writer : %v", err)
-			break
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		if _, err := io.Copy(stream, resp.Body); err != nil {
+			log.Printf("Unable to pipe response body : %v", err)
+			return
 		}
-		_, err = io.Copy(bodyWriter, resp.Body)
-		if err != nil {
-			log.Printf("Unable to get pipe response body : %v", err)
-			break
+		stream.CloseWrite()
+		return
+	}
+
+	if err := wsp.Join(stream, &wsp.BufferedConn{Conn: conn, Reader: reader}); err != nil {
+		log.Printf("Websocket passthrough to %s ended : %v", req.URL, err)
+	}
+}
+
+// serveDial opens the raw TCP connection described by a dial stream and
+// pipes it to the stream.
+func (connection *Connection) serveDial(ctx context.Context, stream *wsp.Stream) {
+	dialRequest := new(wsp.DialRequest)
+	if err := json.Unmarshal(stream.Header(), dialRequest); err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to deserialize dial request : %s\n", err))
+		return
+	}
+
+	config := connection.pool.client.getConfig()
+	if !config.AllowTunnels {
+		connection.error(stream, http.StatusForbidden, "Forbidden tunnel : tunnels are disabled\n")
+		return
+	}
+
+	host, port, err := net.SplitHostPort(dialRequest.Address)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Invalid dial address : %v\n", err))
+		return
+	}
+
+	destinations, _ := wsp.ParseDestinations(config.Destinations)
+	if !wsp.MatchDestinationsHost(destinations, host, port) {
+		connection.error(stream, http.StatusForbidden, fmt.Sprintf("Forbidden tunnel : %s is not an advertised destination\n", dialRequest.Address))
+		return
+	}
+
+	if err := wsp.CheckRules(wsp.TunnelRequest(dialRequest.Address, nil), config.Whitelist, config.Blacklist); err != nil {
+		connection.error(stream, http.StatusForbidden, fmt.Sprintf("Forbidden tunnel : %v\n", err))
+		return
+	}
+
+	log.Printf("[DIAL] %s", dialRequest.Address)
+
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", dialRequest.Address)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to dial %s : %v\n", dialRequest.Address, err))
+		return
+	}
+	defer conn.Close()
+
+	resp := wsp.NewHTTPResponse()
+	resp.StatusCode = http.StatusOK
+	jsonResponse, err := json.Marshal(resp)
+	if err != nil {
+		connection.error(stream, 527, fmt.Sprintf("Unable to serialize response : %v\n", err))
+		return
+	}
+
+	if err := stream.Reply(jsonResponse); err != nil {
+		log.Printf("Unable to write response : %v", err)
+		return
+	}
+
+	if err := wsp.Join(stream, conn); err != nil {
+		log.Printf("Tunnel to %s ended : %v", dialRequest.Address, err)
+	}
+}
+
+// begin accounts for a new stream, refusing it once the connection drains.
+func (connection *Connection) begin(ctx context.Context) bool {
+	maxStreams := connection.pool.client.getConfig().MaxStreams
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	if connection.draining {
+		return false
+	}
+
+	connection.streams++
+	connection.status = RUNNING
+	if connection.streams >= maxStreams {
+		go connection.pool.connector(ctx)
+	}
+	return true
+}
+
+func (connection *Connection) end() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	connection.streams--
+	if connection.streams == 0 {
+		connection.status = IDLE
+		if connection.draining {
+			go connection.goAway()
 		}
-		bodyWriter.Close()
 	}
 }
 
-func (connection *Connection) error(msg string) (err error) {
+// drain refuses new streams and closes the connection once the streams in
+// flight completed.
+func (connection *Connection) drain() {
+	connection.lock.Lock()
+	connection.draining = true
+	idle := connection.status != RUNNING
+	connection.lock.Unlock()
+
+	if idle {
+		connection.goAway()
+	}
+}
+
+func (connection *Connection) goAway() {
+	if connection.mux != nil {
+		connection.mux.GoAway("client shutting down")
+	}
+	connection.Close()
+}
+
+// available reports whether the connection is established and can take
+// another stream.
+func (connection *Connection) available() bool {
+	maxStreams := connection.pool.client.getConfig().MaxStreams
+
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status != CONNECTING && connection.streams < maxStreams
+}
+
+func (connection *Connection) getStatus() int {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	return connection.status
+}
+
+func (connection *Connection) error(stream *wsp.Stream, statusCode int, msg string) (err error) {
 	resp := wsp.NewHTTPResponse()
-	resp.StatusCode = 527
+	resp.StatusCode = statusCode
 
 	log.Println(msg)
 	resp.ContentLength = int64(len(msg))
@@ -159,25 +428,29 @@ func (connection *Connection) error(msg string) (err error) {
 		return
 	}
 
-	err = connection.ws.WriteMessage(websocket.TextMessage, jsonResponse)
+	err = stream.Reply(jsonResponse)
 	if err != nil {
-		log.Printf("Unable to write response body : %v", err)
+		log.Printf("Unable to write response : %v", err)
 		return
 	}
 
-	err = connection.ws.WriteMessage(websocket.BinaryMessage, []byte(msg))
+	_, err = io.Copy(stream, strings.NewReader(msg))
 	if err != nil {
 		log.Printf("Unable to write response body : %v", err)
 		return
 	}
 
-	return
+	return stream.CloseWrite()
 }
 
 func (connection *Connection) Close() {
 	connection.pool.lock.Lock()
 
 	defer connection.pool.lock.Unlock()
-	connection.pool.remove(connection)
-	connection.ws.Close()
+	if connection.pool.remove(connection) && connection.getStatus() != CONNECTING {
+		connection.pool.client.metrics.disconnects.Inc(connection.pool.target)
+	}
+	if connection.mux != nil {
+		connection.mux.Close()
+	}
 }
@@ -0,0 +1,67 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/metrics"
+)
+
+type clientMetrics struct {
+	registry    *metrics.Registry
+	connects    *metrics.Counter
+	disconnects *metrics.Counter
+	duration    *metrics.Histogram
+}
+
+func newClientMetrics(c *Client) (m *clientMetrics) {
+	m = new(clientMetrics)
+	m.registry = metrics.NewRegistry()
+
+	m.registry.NewGaugeFunc("wsp_client_connections", "Connections to each target by state.", []string{"target", "state"}, func() (samples []metrics.Sample) {
+		for _, pool := range c.getPools() {
+			ps := pool.getSize()
+			samples = append(samples,
+				metrics.Sample{Labels: []string{pool.target, "connecting"}, Value: float64(ps.connecting)},
+				metrics.Sample{Labels: []string{pool.target, "idle"}, Value: float64(ps.idle)},
+				metrics.Sample{Labels: []string{pool.target, "running"}, Value: float64(ps.running)},
+			)
+		}
+		return
+	})
+	m.registry.NewGaugeFunc("wsp_client_circuit", "Circuit breaker state of each target.", []string{"target", "state"}, func() (samples []metrics.Sample) {
+		for _, pool := range c.getPools() {
+			circuit, _ := pool.getCircuit()
+			for _, state := range []circuitState{circuitClosed, circuitHalfOpen, circuitOpen} {
+				value := 0.0
+				if state == circuit {
+					value = 1
+				}
+				samples = append(samples, metrics.Sample{Labels: []string{pool.target, state.String()}, Value: value})
+			}
+		}
+		return
+	})
+	m.registry.NewGaugeFunc("wsp_client_connect_failures", "Consecutive connection failures to each target.", []string{"target"}, func() (samples []metrics.Sample) {
+		for _, pool := range c.getPools() {
+			_, failures := pool.getCircuit()
+			samples = append(samples, metrics.Sample{Labels: []string{pool.target}, Value: float64(failures)})
+		}
+		return
+	})
+
+	m.connects = m.registry.NewCounter("wsp_client_connects_total", "Connection attempts to each target by result.", "target", "result")
+	m.disconnects = m.registry.NewCounter("wsp_client_disconnects_total", "Established connections lost for each target.", "target")
+	m.duration = m.registry.NewHistogram("wsp_client_request_duration_seconds", "Time for destinations to answer proxied requests, by target and response status class.", metrics.DefaultBuckets, "target", "status")
+
+	return
+}
+
+// statusClass labels a response status by class, 2xx to 5xx, so that the
+// number of label values stays bounded.
+func statusClass(resp *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	return strconv.Itoa(resp.StatusCode/100) + "xx"
+}
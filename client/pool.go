@@ -4,10 +4,34 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
+	"math/rand"
 	"sync"
 	"time"
 )
 
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// Pool keeps connections to one target. Once connecting fails, attempts are
+// spaced by the configured backoff and made one at a time until one succeeds.
 type Pool struct {
 	lock        sync.RWMutex
 	client      *Client
@@ -15,6 +39,10 @@ type Pool struct {
 	secretKey   string
 	connections []*Connection
 	done        chan struct{}
+
+	failures int
+	retryAt  time.Time
+	circuit  circuitState
 }
 
 func NewPool(client *Client, target string, secretKey string) (pool *Pool) {
@@ -27,36 +55,81 @@ func NewPool(client *Client, target string, secretKey string) (pool *Pool) {
 	return
 }
 
+func (pool *Pool) setSecretKey(secretKey string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.secretKey = secretKey
+}
+
+func (pool *Pool) getSecretKey() string {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.secretKey
+}
+
 func (pool *Pool) Start(ctx context.Context) {
 	pool.connector(ctx)
 	go func() {
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
-	L:
 		for {
+			timer := time.NewTimer(pool.nextCheck())
 			select {
 			case <-pool.done:
-				break L
-			case <-ticker.C:
+				timer.Stop()
+				return
+			case <-timer.C:
 				pool.connector(ctx)
 			}
 		}
 	}()
 }
 
+// nextCheck returns how long to wait before the connector runs again.
+func (pool *Pool) nextCheck() time.Duration {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	if wait := time.Until(pool.retryAt); pool.failures > 0 && wait > 0 {
+		return wait
+	}
+	return time.Second
+}
+
 func (pool *Pool) connector(ctx context.Context) {
+	config := pool.client.getConfig()
+
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
+	// Checked under the lock so that Drain sees every connection opened
+	// before it was called, and none is opened after.
+	select {
+	case <-pool.done:
+		return
+	default:
+	}
+
 	poolSize := pool.Size()
 
-	toCreate := pool.client.Config.PoolIdleSize - poolSize.idle
+	toCreate := config.PoolIdleSize - poolSize.available
 	if poolSize.total == 0 {
 		toCreate = 1
 	}
 
-	if poolSize.total+toCreate > pool.client.Config.PoolMaxSize {
-		toCreate = pool.client.Config.PoolMaxSize - poolSize.total
+	if poolSize.total+toCreate > config.PoolMaxSize {
+		toCreate = config.PoolMaxSize - poolSize.total
+	}
+
+	if pool.failures > 0 && toCreate > 0 {
+		if time.Now().Before(pool.retryAt) || poolSize.connecting > 0 {
+			return
+		}
+		if pool.circuit == circuitOpen {
+			log.Printf("Circuit to %s half-open, probing", pool.target)
+			pool.circuit = circuitHalfOpen
+		}
+		toCreate = 1
 	}
 
 	for i := 0; i < toCreate; i++ {
@@ -65,34 +138,107 @@ func (pool *Pool) connector(ctx context.Context) {
 
 		go func() {
 			err := conn.Connect(ctx)
+			backoff := pool.client.getConfig().Backoff
+
+			pool.lock.Lock()
+			defer pool.lock.Unlock()
+
 			if err != nil {
 				log.Printf("Unable to connect to %s : %s", pool.target, err)
-
-				pool.lock.Lock()
-				defer pool.lock.Unlock()
+				pool.client.metrics.connects.Inc(pool.target, "failure")
 				pool.remove(conn)
+				pool.failed(&backoff)
+				return
+			}
+
+			pool.client.metrics.connects.Inc(pool.target, "success")
+			if pool.failures > 0 {
+				pool.recovered()
+				go pool.connector(ctx)
 			}
 		}()
 	}
 }
 
+// failed schedules the next attempt after a connection failure and opens the
+// circuit once the failure threshold is reached.
+func (pool *Pool) failed(backoff *Backoff) {
+	pool.failures++
+	delay := backoff.Delay(pool.failures)
+	pool.retryAt = time.Now().Add(delay)
+
+	if pool.failures >= backoff.Threshold && pool.circuit != circuitOpen {
+		log.Printf("Circuit to %s open after %d failures", pool.target, pool.failures)
+		pool.circuit = circuitOpen
+	}
+	log.Printf("Retrying %s in %s", pool.target, delay.Round(time.Millisecond))
+}
+
+// recovered resets the backoff once a connection succeeded.
+func (pool *Pool) recovered() {
+	if pool.circuit != circuitClosed {
+		log.Printf("Circuit to %s closed", pool.target)
+	}
+	pool.failures = 0
+	pool.retryAt = time.Time{}
+	pool.circuit = circuitClosed
+}
+
+// getCircuit returns the circuit state and the consecutive failures count.
+func (pool *Pool) getCircuit() (circuitState, int) {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.circuit, pool.failures
+}
+
+// Delay returns the wait before the next attempt after failures consecutive
+// failures.
+func (backoff *Backoff) Delay(failures int) time.Duration {
+	delay := float64(backoff.Min) * math.Pow(backoff.Factor, float64(failures-1))
+	if delay > float64(backoff.Max) {
+		delay = float64(backoff.Max)
+	}
+	delay -= delay * backoff.Jitter * rand.Float64()
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
 func (pool *Pool) add(conn *Connection) {
 	pool.connections = append(pool.connections, conn)
 }
 
-func (pool *Pool) remove(conn *Connection) {
+func (pool *Pool) remove(conn *Connection) (removed bool) {
 	var filtered []*Connection
 	for _, c := range pool.connections {
 		if conn != c {
 			filtered = append(filtered, c)
+		} else {
+			removed = true
 		}
 	}
 	pool.connections = filtered
+	return
 }
 
-func (pool *Pool) Shutdown() {
+// Drain stops opening connections and drains the established ones.
+func (pool *Pool) Drain() {
 	close(pool.done)
-	for _, conn := range pool.connections {
+
+	pool.lock.RLock()
+	connections := append([]*Connection(nil), pool.connections...)
+	pool.lock.RUnlock()
+
+	for _, conn := range connections {
+		conn.drain()
+	}
+}
+
+func (pool *Pool) Shutdown() {
+	pool.lock.RLock()
+	connections := append([]*Connection(nil), pool.connections...)
+	pool.lock.RUnlock()
+
+	for _, conn := range connections {
 		conn.Close()
 	}
 }
@@ -101,18 +247,31 @@ type PoolSize struct {
 	connecting int
 	idle       int
 	running    int
+	available  int
 	total      int
 }
 
 func (poolSize *PoolSize) String() string {
-	return fmt.Sprintf("Connecting %d, idle %d, running %d, total %d", poolSize.connecting, poolSize.idle, poolSize.running, poolSize.total)
+	return fmt.Sprintf("Connecting %d, idle %d, running %d, available %d, total %d", poolSize.connecting, poolSize.idle, poolSize.running, poolSize.available, poolSize.total)
+}
+
+// getSize is Size for callers not holding the pool lock.
+func (pool *Pool) getSize() *PoolSize {
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	return pool.Size()
 }
 
 func (pool *Pool) Size() (poolSize *PoolSize) {
 	poolSize = new(PoolSize)
 	poolSize.total = len(pool.connections)
 	for _, connection := range pool.connections {
-		switch connection.status {
+		if connection.available() {
+			poolSize.available++
+		}
+
+		switch connection.getStatus() {
 		case CONNECTING:
 			poolSize.connecting++
 		case IDLE:
@@ -7,14 +7,17 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/hirasawayuki/reverse-proxy-websocket/client"
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
 func main() {
 	ctx := context.Background()
 
 	configFile := flag.String("config", "wsp_client.cfg", "config file path")
+	watch := flag.Bool("watch", false, "reload the config file when it changes")
 	flag.Parse()
 
 	config, err := client.LoadConfiguration(*configFile)
@@ -26,8 +29,28 @@ func main() {
 	proxy.Start(ctx)
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	proxy.Shutdown()
+	var changed <-chan time.Time
+	if *watch {
+		changed = wsp.WatchFile(*configFile, 2*time.Second)
+	}
+
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				proxy.Shutdown()
+				return
+			}
+		case <-changed:
+		}
+
+		config, err := client.LoadConfiguration(*configFile)
+		if err != nil {
+			log.Printf("Unable to reload configuration : %s", err)
+			continue
+		}
+		proxy.Reload(config)
+	}
 }
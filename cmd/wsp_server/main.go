@@ -6,12 +6,15 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/hirasawayuki/reverse-proxy-websocket/server"
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
 func main() {
 	configfile := flag.String("config", "wsp_server.cfg", "config file path")
+	watch := flag.Bool("watch", false, "reload the config file when it changes")
 	flag.Parse()
 
 	config, err := server.LoadConfiguration(*configfile)
@@ -19,12 +22,32 @@ func main() {
 		log.Fatalf("Unable to load configuration : %s", err)
 	}
 
-	server := server.NewServer(config)
-	server.Start()
+	proxy := server.NewServer(config)
+	proxy.Start()
 
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	<-sigCh
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
-	server.Shutdown()
+	var changed <-chan time.Time
+	if *watch {
+		changed = wsp.WatchFile(*configfile, 2*time.Second)
+	}
+
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig != syscall.SIGHUP {
+				proxy.Shutdown()
+				return
+			}
+		case <-changed:
+		}
+
+		config, err := server.LoadConfiguration(*configfile)
+		if err != nil {
+			log.Printf("Unable to reload configuration : %s", err)
+			continue
+		}
+		proxy.Reload(config)
+	}
 }
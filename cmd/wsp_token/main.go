@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/server"
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+func main() {
+	configFile := flag.String("config", "wsp_server.cfg", "server config file path")
+	id := flag.String("id", "", "client id the token is issued for")
+	key := flag.String("key", "", "name of the server key signing the token")
+	ttl := flag.Duration("ttl", 0, "token lifetime, 0 for no expiry")
+	flag.Parse()
+
+	config, err := server.LoadConfiguration(*configFile)
+	if err != nil {
+		log.Fatalf("Unable to load configuration : %s", err)
+	}
+
+	if *id == "" {
+		log.Fatal("Missing -id")
+	}
+
+	if *key == "" && len(config.Keys) == 1 {
+		for name := range config.Keys {
+			*key = name
+		}
+	}
+	secret, ok := config.Keys[*key]
+	if !ok {
+		log.Fatalf("Unknown key %q", *key)
+	}
+
+	token := &wsp.Token{ID: *id, Key: *key}
+	if *ttl > 0 {
+		token.Expires = time.Now().Add(*ttl).Unix()
+	}
+
+	signed, err := token.Sign(secret)
+	if err != nil {
+		log.Fatalf("Unable to sign token : %s", err)
+	}
+	fmt.Println(signed)
+}
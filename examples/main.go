@@ -2,10 +2,13 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 var addr = flag.String("addr", "localhost:8081", "http service address")
@@ -43,11 +46,49 @@ func sleep(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("ok"))
 }
 
+func stream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(w, "data: tick %d\n\n", i)
+		flusher.Flush()
+		time.Sleep(time.Second)
+	}
+}
+
+var upgrader = websocket.Upgrader{}
+
+func echo(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer ws.Close()
+
+	for {
+		messageType, message, err := ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(messageType, message); err != nil {
+			return
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 	http.HandleFunc("/hello", hello)
 	http.HandleFunc("/header", header)
 	http.HandleFunc("/fail", fail)
 	http.HandleFunc("/sleep", sleep)
+	http.HandleFunc("/stream", stream)
+	http.HandleFunc("/echo", echo)
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and serves them in the Prometheus text exposition
+// format.
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (registry *Registry) register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	registry.lock.Lock()
+	metrics := registry.metrics
+	registry.lock.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	bw.Flush()
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+func (d *desc) writeSample(w *bufio.Writer, suffix string, values []string, extra string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+
+	pairs := make([]string, 0, len(values)+1)
+	for i, label := range d.labels {
+		pairs = append(pairs, label+`="`+escape(values[i])+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+func escape(value string) string {
+	return strings.NewReplacer("\\", `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// series keeps one value per label combination, in insertion order.
+type series struct {
+	desc
+	lock   sync.Mutex
+	keys   []string
+	values map[string][]string
+	data   map[string]float64
+}
+
+func newSeries(name string, help string, kind string, labels []string) (s *series) {
+	s = new(series)
+	s.desc = desc{name: name, help: help, kind: kind, labels: labels}
+	s.values = make(map[string][]string)
+	s.data = make(map[string]float64)
+	return
+}
+
+func (s *series) update(values []string, f func(float64) float64) {
+	key := s.key(values)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.values[key]; !ok {
+		s.keys = append(s.keys, key)
+		s.values[key] = append([]string(nil), values...)
+	}
+	s.data[key] = f(s.data[key])
+}
+
+func (s *series) write(w *bufio.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.writeHeader(w)
+	if len(s.keys) == 0 && len(s.labels) == 0 {
+		s.writeSample(w, "", nil, "", 0)
+	}
+	for _, key := range s.keys {
+		s.writeSample(w, "", s.values[key], "", s.data[key])
+	}
+}
+
+type Counter struct {
+	*series
+}
+
+func (registry *Registry) NewCounter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{newSeries(name, help, "counter", labels)}
+	registry.register(counter)
+	return counter
+}
+
+func (counter *Counter) Inc(values ...string) {
+	counter.Add(1, values...)
+}
+
+func (counter *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		return
+	}
+	counter.update(values, func(v float64) float64 { return v + delta })
+}
+
+type Gauge struct {
+	*series
+}
+
+func (registry *Registry) NewGauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{newSeries(name, help, "gauge", labels)}
+	registry.register(gauge)
+	return gauge
+}
+
+func (gauge *Gauge) Set(value float64, values ...string) {
+	gauge.update(values, func(float64) float64 { return value })
+}
+
+func (gauge *Gauge) Add(delta float64, values ...string) {
+	gauge.update(values, func(v float64) float64 { return v + delta })
+}
+
+// Sample is one value reported by a GaugeFunc.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// GaugeFunc reports values computed at scrape time.
+type GaugeFunc struct {
+	desc
+	collect func() []Sample
+}
+
+func (registry *Registry) NewGaugeFunc(name string, help string, labels []string, collect func() []Sample) *GaugeFunc {
+	gauge := &GaugeFunc{desc{name: name, help: help, kind: "gauge", labels: labels}, collect}
+	registry.register(gauge)
+	return gauge
+}
+
+func (gauge *GaugeFunc) write(w *bufio.Writer) {
+	gauge.writeHeader(w)
+	for _, sample := range gauge.collect() {
+		gauge.key(sample.Labels)
+		gauge.writeSample(w, "", sample.Labels, "", sample.Value)
+	}
+}
+
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type Histogram struct {
+	desc
+	buckets []float64
+
+	lock   sync.Mutex
+	keys   []string
+	values map[string][]string
+	counts map[string][]uint64
+	sums   map[string]float64
+}
+
+func (registry *Registry) NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	histogram := new(Histogram)
+	histogram.desc = desc{name: name, help: help, kind: "histogram", labels: labels}
+	histogram.buckets = append([]float64(nil), buckets...)
+	sort.Float64s(histogram.buckets)
+	histogram.values = make(map[string][]string)
+	histogram.counts = make(map[string][]uint64)
+	histogram.sums = make(map[string]float64)
+	registry.register(histogram)
+	return histogram
+}
+
+func (histogram *Histogram) Observe(value float64, values ...string) {
+	key := histogram.key(values)
+
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	counts, ok := histogram.counts[key]
+	if !ok {
+		histogram.keys = append(histogram.keys, key)
+		histogram.values[key] = append([]string(nil), values...)
+		counts = make([]uint64, len(histogram.buckets)+1)
+		histogram.counts[key] = counts
+	}
+
+	i := sort.SearchFloat64s(histogram.buckets, value)
+	counts[i]++
+	histogram.sums[key] += value
+}
+
+func (histogram *Histogram) write(w *bufio.Writer) {
+	histogram.lock.Lock()
+	defer histogram.lock.Unlock()
+
+	histogram.writeHeader(w)
+	for _, key := range histogram.keys {
+		values := histogram.values[key]
+		counts := histogram.counts[key]
+
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += counts[i]
+			histogram.writeSample(w, "_bucket", values, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		cumulative += counts[len(histogram.buckets)]
+		histogram.writeSample(w, "_bucket", values, `le="+Inf"`, float64(cumulative))
+		histogram.writeSample(w, "_sum", values, "", histogram.sums[key])
+		histogram.writeSample(w, "_count", values, "", float64(cumulative))
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+// authenticate checks the credential of a registering client. It returns the
+// client ID bound to its token, or an empty ID for the shared secret key,
+// only accepted along with tokens during a TokenMigration.
+func (s *Server) authenticate(r *http.Request) (id string, err error) {
+	config := s.getConfig()
+
+	if bearer := r.Header.Get("Authorization"); strings.HasPrefix(bearer, "Bearer ") && len(config.Keys) > 0 {
+		token, err := wsp.ParseToken(strings.TrimPrefix(bearer, "Bearer "), config.Keys)
+		if err != nil {
+			return "", fmt.Errorf("Invalid token : %w", err)
+		}
+		if s.revocations.Revoked(token.ID) {
+			return "", fmt.Errorf("Revoked token for %s", token.ID)
+		}
+		return token.ID, nil
+	}
+
+	secretKey := r.Header.Get("X-SECRET-KEY")
+	if config.SecretKey == "" && len(config.Keys) > 0 {
+		return "", fmt.Errorf("Missing token")
+	}
+	if subtle.ConstantTimeCompare([]byte(secretKey), []byte(config.SecretKey)) != 1 {
+		return "", fmt.Errorf("Invalid X-SECRET-KEY")
+	}
+	return "", nil
+}
+
+// revocationList holds the client IDs listed in the revocation file, one per
+// line. It is reloaded whenever the file changes.
+type revocationList struct {
+	lock    sync.RWMutex
+	path    string
+	modTime time.Time
+	ids     map[string]bool
+	missing bool
+}
+
+func newRevocationList(path string) (list *revocationList) {
+	list = new(revocationList)
+	list.path = path
+	list.ids = make(map[string]bool)
+	return
+}
+
+// SetPath switches to another revocation file, loaded on the next Reload.
+func (list *revocationList) SetPath(path string) {
+	list.lock.Lock()
+	defer list.lock.Unlock()
+
+	if path != list.path {
+		list.path = path
+		list.modTime = time.Time{}
+		list.ids = make(map[string]bool)
+		list.missing = false
+	}
+}
+
+func (list *revocationList) Revoked(id string) bool {
+	list.lock.RLock()
+	defer list.lock.RUnlock()
+
+	return list.ids[id]
+}
+
+// Reload reads the revocation file again if it was modified and reports
+// whether it did. A missing file does not clear the list, as that would let
+// the clients it revoked register again : they stay revoked until the file is
+// back, and the error is only reported once.
+func (list *revocationList) Reload() (reloaded bool, err error) {
+	list.lock.RLock()
+	path, modTime := list.path, list.modTime
+	list.lock.RUnlock()
+
+	if path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		list.lock.Lock()
+		defer list.lock.Unlock()
+
+		if list.path != path || list.missing {
+			return false, nil
+		}
+		list.missing = true
+		list.modTime = time.Time{}
+		return false, fmt.Errorf("revocation list is missing, %d client(s) stay revoked until it is back : %w", len(list.ids), err)
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = true
+	}
+	if err = scanner.Err(); err != nil {
+		return false, err
+	}
+
+	list.lock.Lock()
+	if list.path == path {
+		list.ids = ids
+		list.modTime = info.ModTime()
+		list.missing = false
+	}
+	list.lock.Unlock()
+
+	return true, nil
+}
+
+// reloadRevocations reloads the revocation list and disconnects the pools
+// of the clients it revokes.
+func (s *Server) reloadRevocations() {
+	reloaded, err := s.revocations.Reload()
+	if err != nil {
+		log.Printf("Unable to load revocation list : %s", err)
+		return
+	}
+	if !reloaded {
+		return
+	}
+
+	log.Printf("Loaded revocation list %s", s.getConfig().RevocationList)
+	for _, pool := range s.getPools() {
+		if s.revocations.Revoked(string(pool.id)) {
+			log.Printf("Disconnecting revoked client %s", pool.id)
+			pool.Shutdown()
+		}
+	}
+}
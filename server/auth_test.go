@@ -0,0 +1,52 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevocationListMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("# revoked clients\nclient-a\n\nclient-b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	list := newRevocationList(path)
+	if reloaded, err := list.Reload(); !reloaded || err != nil {
+		t.Fatalf("got %v, %v, expected the list to load", reloaded, err)
+	}
+	if !list.Revoked("client-a") || !list.Revoked("client-b") || list.Revoked("client-c") {
+		t.Fatal("expected client-a and client-b only to be revoked")
+	}
+
+	// A missing file is reported once and keeps the clients revoked.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := list.Reload(); err == nil {
+		t.Fatal("expected the missing file to be reported")
+	}
+	if _, err := list.Reload(); err != nil {
+		t.Fatalf("got %v, expected the missing file to be reported only once", err)
+	}
+	if !list.Revoked("client-a") || !list.Revoked("client-b") {
+		t.Fatal("expected clients to stay revoked while the file is missing")
+	}
+
+	// The file is loaded again once back, even with its former time.
+	if err := os.WriteFile(path, []byte("client-b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := list.Reload(); !reloaded || err != nil {
+		t.Fatalf("got %v, %v, expected the list to load again", reloaded, err)
+	}
+	if list.Revoked("client-a") || !list.Revoked("client-b") {
+		t.Fatal("expected client-b only to be revoked")
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Balancer decides which pool a request is dispatched to. Order returns the
+// pools in the order the scheduler should try them, key being the request
+// affinity key used by consistent hashing.
+type Balancer interface {
+	Order(pools []*Pool, key string) []*Pool
+}
+
+// Load balancing strategies.
+const (
+	BalanceRandom         = "random"
+	BalanceRoundRobin     = "round-robin"
+	BalanceLeastBusy      = "least-busy"
+	BalanceWeighted       = "weighted"
+	BalanceConsistentHash = "consistent-hash"
+)
+
+// NewBalancer returns the balancer implementing strategy, random when empty.
+func NewBalancer(strategy string) (Balancer, error) {
+	switch strategy {
+	case "", BalanceRandom:
+		return new(randomBalancer), nil
+	case BalanceRoundRobin:
+		return new(roundRobinBalancer), nil
+	case BalanceLeastBusy:
+		return new(leastBusyBalancer), nil
+	case BalanceWeighted:
+		return new(weightedBalancer), nil
+	case BalanceConsistentHash:
+		return new(consistentHashBalancer), nil
+	}
+	return nil, fmt.Errorf("unknown balancer strategy %q", strategy)
+}
+
+// randomBalancer picks any pool with an idle connection.
+type randomBalancer struct{}
+
+func (*randomBalancer) Order(pools []*Pool, key string) []*Pool {
+	rand.Shuffle(len(pools), func(i, j int) { pools[i], pools[j] = pools[j], pools[i] })
+	return pools
+}
+
+// roundRobinBalancer starts each request at the pool after the one the
+// previous request started at.
+type roundRobinBalancer struct {
+	lock sync.Mutex
+	next int
+}
+
+func (balancer *roundRobinBalancer) Order(pools []*Pool, key string) []*Pool {
+	if len(pools) == 0 {
+		return pools
+	}
+
+	balancer.lock.Lock()
+	start := balancer.next % len(pools)
+	balancer.next = start + 1
+	balancer.lock.Unlock()
+
+	ordered := make([]*Pool, 0, len(pools))
+	ordered = append(ordered, pools[start:]...)
+	return append(ordered, pools[:start]...)
+}
+
+// leastBusyBalancer prefers the pools using the smallest share of their
+// streams, picking at random among equally busy ones.
+type leastBusyBalancer struct{}
+
+func (*leastBusyBalancer) Order(pools []*Pool, key string) []*Pool {
+	loads := make(map[*Pool]float64, len(pools))
+	for _, pool := range pools {
+		loads[pool] = pool.load()
+	}
+	rand.Shuffle(len(pools), func(i, j int) { pools[i], pools[j] = pools[j], pools[i] })
+	sort.SliceStable(pools, func(i, j int) bool { return loads[pools[i]] < loads[pools[j]] })
+	return pools
+}
+
+// weightedBalancer picks pools at random in proportion to the capacity
+// their client advertised.
+type weightedBalancer struct{}
+
+func (*weightedBalancer) Order(pools []*Pool, key string) []*Pool {
+	// Weighted sampling without replacement : sort on u^(1/weight).
+	scores := make(map[*Pool]float64, len(pools))
+	for _, pool := range pools {
+		scores[pool] = math.Pow(rand.Float64(), 1/float64(pool.capacity()))
+	}
+	sort.Slice(pools, func(i, j int) bool { return scores[pools[i]] > scores[pools[j]] })
+	return pools
+}
+
+// consistentHashBalancer sends the requests with the same key to the same
+// pool as long as it is connected, using rendezvous hashing so only the keys
+// of a pool leaving or joining move. Requests wait for that pool when it is
+// busy, see affine.
+type consistentHashBalancer struct{}
+
+func (*consistentHashBalancer) Order(pools []*Pool, key string) []*Pool {
+	scores := make(map[*Pool]uint64, len(pools))
+	for _, pool := range pools {
+		hash := fnv.New64a()
+		hash.Write([]byte(key))
+		hash.Write([]byte{0})
+		hash.Write([]byte(pool.id))
+		scores[pool] = hash.Sum64()
+	}
+	sort.Slice(pools, func(i, j int) bool { return scores[pools[i]] > scores[pools[j]] })
+	return pools
+}
+
+// affine restricts accept to the connected pool ranked first for key when
+// balancing by consistent hashing, so that requests wait for it rather than
+// go to another pool while it is busy.
+func (s *Server) affine(key string, accept func(*Pool) bool) func(*Pool) bool {
+	balancer, ok := s.getConfig().getBalancer().(*consistentHashBalancer)
+	if !ok {
+		return accept
+	}
+
+	var pools []*Pool
+	for _, pool := range s.getPools() {
+		if accept(pool) && pool.IsConnected() {
+			pools = append(pools, pool)
+		}
+	}
+	if len(pools) == 0 {
+		return accept
+	}
+
+	first := balancer.Order(pools, key)[0]
+	return func(pool *Pool) bool { return pool == first && accept(pool) }
+}
+
+// balancingKey returns the consistent hashing key of r : the value of the
+// configured hash header, or the destination host when it is missing.
+func (s *Server) balancingKey(r *http.Request) string {
+	if config := s.getConfig().Balancer; config != nil && config.HashHeader != "" {
+		if key := r.Header.Get(config.HashHeader); key != "" {
+			return key
+		}
+	}
+	return r.URL.Host
+}
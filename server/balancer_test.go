@@ -0,0 +1,229 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testPools returns n pools, each with a connection of maxStreams streams.
+func testPools(s *Server, n int, maxStreams int) (pools []*Pool) {
+	for i := 0; i < n; i++ {
+		pool := NewPool(s, PoolID(fmt.Sprintf("pool-%d", i)))
+		pool.maxStreams = maxStreams
+		pool.connections = append(pool.connections, &Connection{pool: pool, status: Idle, maxStreams: maxStreams})
+		pools = append(pools, pool)
+	}
+	return
+}
+
+func order(balancer Balancer, pools []*Pool, key string) []*Pool {
+	return balancer.Order(append([]*Pool(nil), pools...), key)
+}
+
+func TestNewBalancer(t *testing.T) {
+	for strategy, expected := range map[string]Balancer{
+		"":                    new(randomBalancer),
+		BalanceRandom:         new(randomBalancer),
+		BalanceRoundRobin:     new(roundRobinBalancer),
+		BalanceLeastBusy:      new(leastBusyBalancer),
+		BalanceWeighted:       new(weightedBalancer),
+		BalanceConsistentHash: new(consistentHashBalancer),
+	} {
+		balancer, err := NewBalancer(strategy)
+		if err != nil {
+			t.Fatalf("unable to create %q balancer : %s", strategy, err)
+		}
+		if fmt.Sprintf("%T", balancer) != fmt.Sprintf("%T", expected) {
+			t.Errorf("got %T for %q, expected %T", balancer, strategy, expected)
+		}
+	}
+
+	if _, err := NewBalancer("fastest"); err == nil {
+		t.Error("expected an unknown strategy to be invalid")
+	}
+}
+
+func TestBalancerOrder(t *testing.T) {
+	pools := testPools(nil, 4, 1)
+
+	for _, strategy := range []string{BalanceRandom, BalanceRoundRobin, BalanceLeastBusy, BalanceWeighted, BalanceConsistentHash} {
+		t.Run(strategy, func(t *testing.T) {
+			balancer, _ := NewBalancer(strategy)
+
+			// Every pool is tried, once.
+			seen := make(map[*Pool]bool)
+			for _, pool := range order(balancer, pools, "key") {
+				seen[pool] = true
+			}
+			if len(seen) != len(pools) {
+				t.Fatalf("ordered %d distinct pools, expected %d", len(seen), len(pools))
+			}
+
+			if ordered := order(balancer, nil, "key"); len(ordered) != 0 {
+				t.Fatalf("ordered %d pools out of none", len(ordered))
+			}
+		})
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	pools := testPools(nil, 4, 1)
+	balancer := new(randomBalancer)
+
+	first := make(map[*Pool]int)
+	for i := 0; i < 1000; i++ {
+		first[order(balancer, pools, "")[0]]++
+	}
+	for _, pool := range pools {
+		if first[pool] == 0 {
+			t.Errorf("%s never tried first", pool.id)
+		}
+	}
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	pools := testPools(nil, 3, 1)
+	balancer := new(roundRobinBalancer)
+
+	for i := 0; i < 2*len(pools); i++ {
+		ordered := order(balancer, pools, "")
+		for j := range ordered {
+			if expected := pools[(i+j)%len(pools)]; ordered[j] != expected {
+				t.Fatalf("request %d tries %s at %d, expected %s", i, ordered[j].id, j, expected.id)
+			}
+		}
+	}
+
+	// Losing a pool keeps the rotation going.
+	if ordered := order(balancer, pools[:2], ""); len(ordered) != 2 {
+		t.Fatalf("ordered %d pools, expected 2", len(ordered))
+	}
+}
+
+func TestLeastBusyBalancer(t *testing.T) {
+	pools := testPools(nil, 4, 4)
+	for i, streams := range []int{3, 1, 4, 0} {
+		pools[i].connections[0].streams = streams
+	}
+	// A closed connection does not count.
+	pools[0].connections = append(pools[0].connections, &Connection{pool: pools[0], status: Closed, maxStreams: 4})
+
+	ordered := order(new(leastBusyBalancer), pools, "")
+	for i, expected := range []*Pool{pools[3], pools[1], pools[0], pools[2]} {
+		if ordered[i] != expected {
+			t.Fatalf("tries %s at %d, expected %s", ordered[i].id, i, expected.id)
+		}
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	pools := testPools(nil, 2, 1)
+	pools[0].maxSize = 1
+	pools[1].maxSize = 9
+
+	const requests = 10000
+	first := 0
+	for i := 0; i < requests; i++ {
+		if order(new(weightedBalancer), pools, "")[0] == pools[0] {
+			first++
+		}
+	}
+
+	// The smaller pool has a tenth of the capacity.
+	if share := float64(first) / requests; share < 0.05 || share > 0.15 {
+		t.Fatalf("%s tried first for %.1f%% of the requests, expected about 10%%", pools[0].id, 100*share)
+	}
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+	pools := testPools(nil, 5, 1)
+	balancer := new(consistentHashBalancer)
+
+	keys := make([]string, 1000)
+	assigned := make(map[string]*Pool, len(keys))
+	counts := make(map[*Pool]int)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("client-%d", i)
+		assigned[keys[i]] = order(balancer, pools, keys[i])[0]
+		counts[assigned[keys[i]]]++
+	}
+	for _, pool := range pools {
+		if counts[pool] == 0 {
+			t.Errorf("no key maps to %s", pool.id)
+		}
+	}
+
+	// The same key maps to the same pool, whatever the pools order.
+	reversed := make([]*Pool, 0, len(pools))
+	for i := len(pools) - 1; i >= 0; i-- {
+		reversed = append(reversed, pools[i])
+	}
+	for _, key := range keys {
+		if first := order(balancer, reversed, key)[0]; first != assigned[key] {
+			t.Fatalf("key %s maps to %s, then to %s", key, assigned[key].id, first.id)
+		}
+	}
+
+	// Removing a pool only moves its own keys.
+	removed := pools[2]
+	remaining := append(append([]*Pool(nil), pools[:2]...), pools[3:]...)
+	moved := 0
+	for _, key := range keys {
+		first := order(balancer, remaining, key)[0]
+		switch {
+		case assigned[key] == removed:
+			moved++
+		case first != assigned[key]:
+			t.Fatalf("key %s moved from %s to %s, expected only the keys of %s to move", key, assigned[key].id, first.id, removed.id)
+		}
+	}
+	if moved != counts[removed] {
+		t.Fatalf("moved %d keys, expected the %d keys of %s", moved, counts[removed], removed.id)
+	}
+}
+
+func TestAffine(t *testing.T) {
+	config := NewConfig()
+	config.Balancer = &BalancerConfig{Strategy: BalanceConsistentHash}
+	if err := config.Balancer.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(config)
+	defer close(s.done)
+	s.pools = testPools(s, 3, 1)
+
+	acceptAll := func(*Pool) bool { return true }
+	first := order(config.Balancer.balancer, s.pools, "key")[0]
+
+	// Only the pool of the key is accepted, even when busy.
+	first.connections[0].status = Busy
+	first.connections[0].streams = 1
+	accept := s.affine("key", acceptAll)
+	for _, pool := range s.pools {
+		if accept(pool) != (pool == first) {
+			t.Fatalf("%s accepted : %v, expected only %s to be", pool.id, accept(pool), first.id)
+		}
+	}
+
+	// Once disconnected, the key moves to the next pool.
+	first.connections[0].status = Closed
+	next := order(config.Balancer.balancer, s.pools, "key")[1]
+	accept = s.affine("key", acceptAll)
+	for _, pool := range s.pools {
+		if accept(pool) != (pool == next) {
+			t.Fatalf("%s accepted : %v, expected only %s to be", pool.id, accept(pool), next.id)
+		}
+	}
+
+	// Other strategies accept any pool.
+	config.Balancer = &BalancerConfig{Strategy: BalanceRoundRobin}
+	if err := config.Balancer.Compile(); err != nil {
+		t.Fatal(err)
+	}
+	accept = s.affine("key", acceptAll)
+	for _, pool := range s.pools {
+		if !accept(pool) {
+			t.Fatalf("%s not accepted without consistent hashing", pool.id)
+		}
+	}
+}
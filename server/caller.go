@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+// Caller is a user of /request, of the forward and reverse proxies and of
+// /status and /metrics. It authenticates with APIKey in the X-PROXY-API-KEY
+// header, or with Username and Password or Token in the Proxy-Authorization
+// header, and may only use the Pools and Destinations listed, or any of them
+// when empty. Pools are ID patterns.
+type Caller struct {
+	Name         string
+	APIKey       string
+	Username     string
+	Password     string
+	Token        string
+	Pools        []string
+	Destinations []string
+
+	destinations []*wsp.Destination
+}
+
+func (caller *Caller) Compile() (err error) {
+	if caller.Name == "" {
+		return fmt.Errorf("missing caller name")
+	}
+	if caller.APIKey == "" && caller.Username == "" && caller.Token == "" {
+		return fmt.Errorf("caller %s has no credential", caller.Name)
+	}
+	for _, pattern := range caller.Pools {
+		if _, err = path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pool pattern %q for caller %s : %w", pattern, caller.Name, err)
+		}
+	}
+
+	caller.destinations, err = wsp.ParseDestinations(caller.Destinations)
+	if err != nil {
+		return fmt.Errorf("invalid destinations for caller %s : %w", caller.Name, err)
+	}
+
+	return
+}
+
+// AllowsPool reports whether the caller may use pool. A nil caller, when no
+// caller is configured, may use any.
+func (caller *Caller) AllowsPool(pool *Pool) bool {
+	if caller == nil || len(caller.Pools) == 0 {
+		return true
+	}
+	for _, pattern := range caller.Pools {
+		if ok, _ := path.Match(pattern, string(pool.id)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (caller *Caller) AllowsURL(u *url.URL) bool {
+	if caller == nil || len(caller.destinations) == 0 {
+		return true
+	}
+	return wsp.MatchDestinations(caller.destinations, u)
+}
+
+func (caller *Caller) AllowsAddress(host string, port string) bool {
+	if caller == nil || len(caller.destinations) == 0 {
+		return true
+	}
+	return wsp.MatchDestinationsHost(caller.destinations, host, port)
+}
+
+// authenticateCaller finds the configured caller whose credentials r carries
+// and strips them from r so they are not forwarded. It returns a nil caller
+// when no caller is configured.
+func (s *Server) authenticateCaller(r *http.Request) (*Caller, error) {
+	apiKey := r.Header.Get("X-PROXY-API-KEY")
+	authorization := r.Header.Get("Proxy-Authorization")
+	r.Header.Del("X-PROXY-API-KEY")
+	r.Header.Del("Proxy-Authorization")
+
+	callers := s.getConfig().Callers
+	if len(callers) == 0 {
+		return nil, nil
+	}
+
+	var username, password, token string
+	basic := false
+	switch {
+	case strings.HasPrefix(authorization, "Basic "):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authorization, "Basic "))
+		if i := strings.IndexByte(string(decoded), ':'); err == nil && i >= 0 {
+			username, password, basic = string(decoded[:i]), string(decoded[i+1:]), true
+		}
+	case strings.HasPrefix(authorization, "Bearer "):
+		token = strings.TrimPrefix(authorization, "Bearer ")
+	}
+
+	for _, caller := range callers {
+		if apiKey != "" && caller.APIKey != "" && secureEqual(apiKey, caller.APIKey) {
+			return caller, nil
+		}
+		if basic && caller.Username != "" && secureEqual(username, caller.Username) && secureEqual(password, caller.Password) {
+			return caller, nil
+		}
+		if token != "" && caller.Token != "" && secureEqual(token, caller.Token) {
+			return caller, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Proxy authentication required")
+}
+
+// requireCaller serves next only to authenticated callers when callers are
+// configured.
+func (s *Server) requireCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := s.authenticateCaller(r); err != nil {
+			proxyAuthRequired(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func secureEqual(a string, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func proxyAuthRequired(w http.ResponseWriter, err error) {
+	w.Header().Set("Proxy-Authenticate", `Basic realm="wsp"`)
+	wsp.ProxyErrorCode(w, http.StatusProxyAuthRequired, err)
+}
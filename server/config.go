@@ -1,19 +1,214 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 	"gopkg.in/yaml.v2"
 )
 
 type Config struct {
+	Host              string
+	Port              int
+	Timeout           int
+	RequestTimeout    int
+	MaxRequestTimeout int
+	IdleTimeout       int
+	ShutdownTimeout   int
+	SecretKey         string
+	Whitelist         []*wsp.Rule
+	Blacklist         []*wsp.Rule
+	PoolRules         map[string]*PoolRules
+	Forwards          []*Forward
+	ReverseProxy      *ReverseProxy
+	ForwardProxy      *ForwardProxy
+	TLS               *TLS
+	Callers           []*Caller
+	Balancer          *BalancerConfig
+	StickySessions    *StickySessions
+
+	// Keys sign client tokens, by key name. Several may be active at once to
+	// rotate them. RevocationList is a file of revoked client IDs.
+	Keys           map[string]string
+	RevocationList string
+
+	// TokenMigration accepts clients registering with SecretKey while Keys
+	// are set, to move them to tokens one at a time. Until it is over, any
+	// holder of the secret key may register under the ID of a token holder.
+	TokenMigration bool
+}
+
+// TLS serves the main listener over HTTPS. Clients presenting a certificate
+// must have it signed by ClientCA, and RequireClientCert makes one mandatory
+// to register. With CertificateID the pool ID is the certificate common name
+// rather than the ID the client sent.
+type TLS struct {
+	Cert              string
+	Key               string
+	ClientCA          string
+	RequireClientCert bool
+	CertificateID     bool
+
+	config *tls.Config
+}
+
+func (t *TLS) Compile() (err error) {
+	if t.Cert == "" || t.Key == "" {
+		return fmt.Errorf("missing tls cert or key")
+	}
+	if (t.RequireClientCert || t.CertificateID) && t.ClientCA == "" {
+		return fmt.Errorf("client certificates require a client ca")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+	if err != nil {
+		return fmt.Errorf("unable to load tls certificate : %w", err)
+	}
+
+	t.config = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if t.ClientCA != "" {
+		t.config.ClientCAs, err = wsp.LoadCertPool(t.ClientCA)
+		if err != nil {
+			return fmt.Errorf("unable to load client ca : %w", err)
+		}
+		t.config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return
+}
+
+// BalancerConfig selects the load balancing Strategy among the pools able to
+// serve a request : random, round-robin, least-busy, weighted or
+// consistent-hash. The consistent-hash strategy keys requests on the
+// HashHeader header, or on the destination host when it is missing. Each key
+// goes to a single pool while it stays connected : when that pool is busy,
+// requests wait for it up to Timeout rather than go to another pool.
+type BalancerConfig struct {
+	Strategy   string
+	HashHeader string
+
+	balancer Balancer
+}
+
+func (config *BalancerConfig) Compile() (err error) {
+	config.balancer, err = NewBalancer(config.Strategy)
+	return
+}
+
+// StickySessions sends the requests carrying the same Header or Cookie value
+// to the pool that served the first of them, until TTL milliseconds pass
+// without any. A session cookie set by a response is pinned to the pool that
+// sent it. Requests fall back to another pool when the pinned one is gone.
+// At most MaxSessions sessions are kept, the least recently used ones being
+// forgotten first.
+type StickySessions struct {
+	Header      string
+	Cookie      string
+	TTL         int
+	MaxSessions int
+}
+
+func (sticky *StickySessions) Compile() error {
+	if sticky.Header == "" && sticky.Cookie == "" {
+		return fmt.Errorf("sticky sessions need a header or a cookie")
+	}
+	if sticky.TTL < 0 {
+		return fmt.Errorf("invalid sticky session ttl %d", sticky.TTL)
+	}
+	if sticky.TTL == 0 {
+		sticky.TTL = 1800000
+	}
+	if sticky.MaxSessions < 0 {
+		return fmt.Errorf("invalid sticky session max sessions %d", sticky.MaxSessions)
+	}
+	if sticky.MaxSessions == 0 {
+		sticky.MaxSessions = 100000
+	}
+	return nil
+}
+
+func (sticky *StickySessions) GetTTL() time.Duration {
+	return time.Duration(sticky.TTL) * time.Millisecond
+}
+
+// ForwardProxy lets callers use the server as an HTTP(S)_PROXY. CONNECT
+// requests are tunneled through Pool, or any pool when Pool is empty, whose
+// labels match Selector.
+type ForwardProxy struct {
+	Pool     string
+	Selector string
+
+	selector *Selector
+}
+
+// ReverseProxy maps incoming requests to destinations without the caller
+// having to set X-PROXY-DESTINATION. Routes with a Host are also served as
+// virtual hosts on the main listener, except for /register, /request,
+// /status and /metrics.
+type ReverseProxy struct {
+	Listen string
+	Routes []*Route
+}
+
+type Route struct {
 	Host        string
-	Port        int
-	Timeout     int
-	IdleTimeout int
-	SecretKey   string
+	Prefix      string
+	Destination string
+	Selector    string
+
+	destination *url.URL
+	selector    *Selector
+}
+
+func (route *Route) Compile() (err error) {
+	if route.Prefix == "" {
+		route.Prefix = "/"
+	}
+	if !strings.HasPrefix(route.Prefix, "/") {
+		return fmt.Errorf("invalid route prefix %q", route.Prefix)
+	}
+	if _, err = path.Match(strings.ToLower(route.Host), ""); err != nil {
+		return fmt.Errorf("invalid route host %q : %w", route.Host, err)
+	}
+
+	route.destination, err = url.Parse(route.Destination)
+	if err != nil {
+		return fmt.Errorf("invalid route destination %q : %w", route.Destination, err)
+	}
+	if route.destination.Scheme == "" || route.destination.Host == "" {
+		return fmt.Errorf("invalid route destination %q : missing scheme or host", route.Destination)
+	}
+
+	route.selector, err = compileSelector(route.Selector)
+
+	return
+}
+
+// Forward maps a local TCP listener to a destination reached through a
+// client pool. An empty Pool lets any pool serving Destination and matching
+// Selector take it.
+type Forward struct {
+	Listen      string
+	Pool        string
+	Destination string
+	Selector    string
+
+	selector *Selector
+}
+
+// PoolRules filter the requests sent to one pool, like Whitelist and
+// Blacklist do for every pool. Tunnels are matched as CONNECT tcp://host:port.
+type PoolRules struct {
+	Whitelist []*wsp.Rule
+	Blacklist []*wsp.Rule
 }
 
 func (c Config) GetAddr() string {
@@ -24,12 +219,35 @@ func (c Config) GetTimeout() time.Duration {
 	return time.Duration(c.Timeout) * time.Millisecond
 }
 
+func (c Config) GetRequestTimeout() time.Duration {
+	return time.Duration(c.RequestTimeout) * time.Millisecond
+}
+
+func (c Config) GetMaxRequestTimeout() time.Duration {
+	return time.Duration(c.MaxRequestTimeout) * time.Millisecond
+}
+
+func (c Config) GetShutdownTimeout() time.Duration {
+	return time.Duration(c.ShutdownTimeout) * time.Millisecond
+}
+
+// getBalancer returns the configured balancer, random by default.
+func (c Config) getBalancer() Balancer {
+	if c.Balancer == nil {
+		return defaultBalancer
+	}
+	return c.Balancer.balancer
+}
+
+var defaultBalancer = new(randomBalancer)
+
 func NewConfig() (config *Config) {
 	config = new(Config)
 	config.Host = "127.0.0.1"
 	config.Port = 8080
 	config.Timeout = 1000
 	config.IdleTimeout = 60000
+	config.ShutdownTimeout = 30000
 	return
 }
 
@@ -46,5 +264,93 @@ func LoadConfiguration(path string) (config *Config, err error) {
 		return
 	}
 
+	for name, key := range config.Keys {
+		if key == "" {
+			err = fmt.Errorf("empty token key %q", name)
+			return
+		}
+	}
+	if config.SecretKey != "" && len(config.Keys) > 0 && !config.TokenMigration {
+		err = fmt.Errorf("secretkey and token keys are both set, set tokenmigration to accept both")
+		return
+	}
+
+	err = wsp.CompileRules(config.Whitelist)
+	if err != nil {
+		return
+	}
+
+	err = wsp.CompileRules(config.Blacklist)
+	if err != nil {
+		return
+	}
+
+	for _, forward := range config.Forwards {
+		if _, err = net.ResolveTCPAddr("tcp", forward.Listen); err != nil {
+			err = fmt.Errorf("invalid forward listen address %q : %w", forward.Listen, err)
+			return
+		}
+		if _, err = wsp.NewDialRequest(forward.Destination); err != nil {
+			return
+		}
+		if forward.selector, err = compileSelector(forward.Selector); err != nil {
+			return
+		}
+	}
+
+	if config.ForwardProxy != nil {
+		if config.ForwardProxy.selector, err = compileSelector(config.ForwardProxy.Selector); err != nil {
+			return
+		}
+	}
+
+	for _, caller := range config.Callers {
+		if err = caller.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.TLS != nil {
+		if err = config.TLS.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.Balancer != nil {
+		if err = config.Balancer.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.StickySessions != nil {
+		if err = config.StickySessions.Compile(); err != nil {
+			return
+		}
+	}
+
+	if config.ReverseProxy != nil {
+		for _, route := range config.ReverseProxy.Routes {
+			if err = route.Compile(); err != nil {
+				return
+			}
+		}
+	}
+
+	for _, rules := range config.PoolRules {
+		if rules == nil {
+			continue
+		}
+
+		err = wsp.CompileRules(rules.Whitelist)
+		if err != nil {
+			return
+		}
+
+		err = wsp.CompileRules(rules.Blacklist)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
@@ -1,11 +1,16 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -21,22 +26,48 @@ const (
 	Closed
 )
 
+func (status ConnectionsStatus) String() string {
+	switch status {
+	case Idle:
+		return "idle"
+	case Busy:
+		return "busy"
+	case Closed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Connection is a registered websocket. It is Idle without any stream in
+// flight and Busy otherwise, and can be taken by requests as long as it has
+// fewer than maxStreams streams.
 type Connection struct {
-	lock         sync.Mutex
-	pool         *Pool
-	ws           *websocket.Conn
-	status       ConnectionsStatus
-	idleSince    time.Time
-	nextResponse chan chan io.Reader
+	lock       sync.Mutex
+	pool       *Pool
+	ws         *websocket.Conn
+	mux        *wsp.Mux
+	status     ConnectionsStatus
+	streams    int
+	maxStreams int
+	idleSince  time.Time
+
+	remoteAddress string
+	connectedAt   time.Time
 }
 
-func NewConnection(pool *Pool, ws *websocket.Conn) *Connection {
+func NewConnection(pool *Pool, ws *websocket.Conn, maxStreams int) *Connection {
 	c := new(Connection)
 	c.pool = pool
 	c.ws = ws
-	c.nextResponse = make(chan chan io.Reader)
+	c.mux = wsp.NewMux(ws, nil)
 	c.status = Idle
-	c.Release()
+	c.maxStreams = maxStreams
+	if c.maxStreams < 1 {
+		c.maxStreams = 1
+	}
+	c.idleSince = time.Now()
+	c.remoteAddress = ws.RemoteAddr().String()
+	c.connectedAt = c.idleSince
 	go c.read()
 
 	return c
@@ -50,78 +81,275 @@ func (connection *Connection) read() {
 		connection.Close()
 	}()
 
-	for {
-		if connection.status == Closed {
-			break
-		}
+	connection.mux.Serve()
+}
 
-		_, reader, err := connection.ws.NextReader()
-		if err != nil {
-			break
-		}
+func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Request) (err error) {
+	log.Printf("proxy request to %s", connection.pool.id)
+	defer connection.Release()
 
-		if connection.status != Busy {
-			break
-		}
+	jsonReq, err := json.Marshal(wsp.SerializeHTTPRequest(r))
+	if err != nil {
+		return fmt.Errorf("unable to serialize request : %w", err)
+	}
 
-		c := <-connection.nextResponse
-		if c == nil {
-			break
+	stream, err := connection.mux.Open(0, jsonReq)
+	if err != nil {
+		return fmt.Errorf("unable to open stream : %w", err)
+	}
+	defer watch(r.Context(), stream)()
+
+	// The upload is not waited for : a caller stalling in the middle of its
+	// body would otherwise keep the handler and the stream until it resumes.
+	// Closing the stream makes the upload fail, and abortRead makes its
+	// pending read of the caller connection fail right away, along with the
+	// reads net/http makes to drain the body once the handler returns. The
+	// caller connection cannot be reused then, which net/http must know
+	// before it writes the response header : it would lock the body to drain
+	// it otherwise, waiting for the pending read.
+	uploaded := make(chan struct{})
+	closeIfUploading := func() bool {
+		select {
+		case <-uploaded:
+			return false
+		default:
+			w.Header().Set("Connection", "close")
+			return true
+		}
+	}
+	defer func() {
+		stream.Close()
+		if closeIfUploading() && abortRead(r) {
+			<-uploaded
+		}
+	}()
+	go func() {
+		defer close(uploaded)
+		if _, err := io.Copy(stream, r.Body); err != nil {
+			stream.Reset(fmt.Sprintf("unable to pipe request body : %s", err))
+			return
 		}
+		stream.CloseWrite()
+	}()
 
-		c <- reader
-		<-c
+	httpResponse, err := readResponse(stream)
+	if err != nil {
+		return err
 	}
+
+	closeIfUploading()
+	return writeResponse(w, stream, httpResponse)
 }
 
-func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Request) (err error) {
-	log.Printf("proxy request to %s", connection.pool.id)
+// abortRead makes the reads of the HTTP/1 caller connection of r fail from
+// now on, reporting whether it could.
+func abortRead(r *http.Request) bool {
+	if r.ProtoMajor != 1 {
+		return false
+	}
+	conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	return conn.SetReadDeadline(time.Now()) == nil
+}
+
+// proxyUpgrade forwards a websocket handshake and, once the destination
+// switched protocols, pipes raw bytes between the caller and the stream.
+func (connection *Connection) proxyUpgrade(w http.ResponseWriter, r *http.Request) (err error) {
+	log.Printf("proxy upgrade to %s", connection.pool.id)
+	defer connection.Release()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("unable to hijack caller connection")
+	}
 
 	jsonReq, err := json.Marshal(wsp.SerializeHTTPRequest(r))
 	if err != nil {
 		return fmt.Errorf("unable to serialize request : %w", err)
 	}
 
-	if err := connection.ws.WriteMessage(websocket.TextMessage, jsonReq); err != nil {
-		return fmt.Errorf("unable to write request : %w", err)
+	stream, err := connection.mux.Open(wsp.FlagUpgrade, jsonReq)
+	if err != nil {
+		return fmt.Errorf("unable to open stream : %w", err)
 	}
+	defer stream.Close()
 
-	bodyWriter, err := connection.ws.NextWriter(websocket.BinaryMessage)
+	unwatch := watch(r.Context(), stream)
+	httpResponse, err := readResponse(stream)
 	if err != nil {
-		return fmt.Errorf("unable to get request body writer : %w", err)
+		unwatch()
+		return err
 	}
 
-	if _, err := io.Copy(bodyWriter, r.Body); err != nil {
-		return fmt.Errorf("unble to pipe request body : %w", err)
+	if httpResponse.StatusCode != http.StatusSwitchingProtocols {
+		defer unwatch()
+		return writeResponse(w, stream, httpResponse)
 	}
-	if err := bodyWriter.Close(); err != nil {
-		return fmt.Errorf("unable to pipe request body (close) : %w", err)
+	unwatch()
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return fmt.Errorf("unable to hijack caller connection : %w", err)
 	}
 
-	responseChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseChannel
-	responseReader, ok := <-responseChannel
-	if responseReader == nil {
-		if ok {
-			close(responseChannel)
-		}
+	if err := writeSwitchingProtocols(conn, httpResponse.Header); err != nil {
+		conn.Close()
+		log.Printf("Unable to write upgrade response : %s", err)
+		return nil
+	}
+
+	if err := wsp.Join(stream, hijacked(conn, bufrw)); err != nil {
+		log.Printf("Websocket passthrough to %s ended : %s", r.URL, err)
+	}
 
-		return fmt.Errorf("unable to get http response reader: %w", err)
+	return nil
+}
+
+// proxyDial asks the client to open a TCP connection to address and pipes
+// conn through it.
+func (connection *Connection) proxyDial(conn net.Conn, address string) (err error) {
+	log.Printf("proxy tunnel to %s via %s", address, connection.pool.id)
+	defer connection.Release()
+
+	stream, err := connection.dial(context.Background(), address)
+	if err != nil {
+		return err
+	}
+
+	if err := wsp.Join(stream, conn); err != nil {
+		return fmt.Errorf("tunnel to %s ended : %w", address, err)
+	}
+
+	return
+}
+
+// proxyConnect answers a CONNECT request once the client reached address and
+// pipes the hijacked caller connection through it.
+func (connection *Connection) proxyConnect(w http.ResponseWriter, r *http.Request, address string) (err error) {
+	log.Printf("proxy connect to %s via %s", address, connection.pool.id)
+	defer connection.Release()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return fmt.Errorf("unable to hijack caller connection")
 	}
 
-	jsonResponse, err := io.ReadAll(responseReader)
+	stream, err := connection.dial(r.Context(), address)
 	if err != nil {
-		close(responseChannel)
-		return fmt.Errorf("unable to read http response : %w", err)
+		return err
 	}
 
-	close(responseChannel)
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		stream.Close()
+		return fmt.Errorf("unable to hijack caller connection : %w", err)
+	}
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		conn.Close()
+		stream.Close()
+		log.Printf("Unable to write connect response : %s", err)
+		return nil
+	}
+
+	if err := wsp.Join(stream, hijacked(conn, bufrw)); err != nil {
+		log.Printf("Tunnel to %s ended : %s", address, err)
+	}
+
+	return nil
+}
+
+// dial opens a FlagDial stream and waits for the client to reach address,
+// giving up when ctx is done.
+func (connection *Connection) dial(ctx context.Context, address string) (stream *wsp.Stream, err error) {
+	dialRequest, err := wsp.NewDialRequest(address)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonReq, err := json.Marshal(dialRequest)
+	if err != nil {
+		return nil, fmt.Errorf("unable to serialize dial request : %w", err)
+	}
+
+	stream, err = connection.mux.Open(wsp.FlagDial, jsonReq)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open stream : %w", err)
+	}
+
+	unwatch := watch(ctx, stream)
+	httpResponse, err := readResponse(stream)
+	unwatch()
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(stream, 1024))
+		stream.Close()
+		return nil, fmt.Errorf("unable to dial %s : %s", address, strings.TrimSpace(string(msg)))
+	}
+
+	return
+}
+
+// watch resets stream once ctx is done, telling the client to abort, until
+// the returned function is called.
+func watch(ctx context.Context, stream *wsp.Stream) (unwatch func()) {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			stream.Reset(fmt.Sprintf("request canceled : %s", ctx.Err()))
+		case <-stop:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-stopped
+		})
+	}
+}
+
+func readResponse(stream *wsp.Stream) (*wsp.HTTPResponse, error) {
+	jsonResponse, err := stream.ReadReply()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read http response : %w", err)
+	}
 
 	httpResponse := new(wsp.HTTPResponse)
 	if err := json.Unmarshal(jsonResponse, httpResponse); err != nil {
-		return fmt.Errorf("unable to unserialize http response : %w", err)
+		return nil, fmt.Errorf("unable to unserialize http response : %w", err)
 	}
 
+	return httpResponse, nil
+}
+
+// responseStartedError is an error occurring once the response header was
+// written, which can only be reported to the caller by aborting the response.
+type responseStartedError struct {
+	err error
+}
+
+func (err *responseStartedError) Error() string {
+	return err.err.Error()
+}
+
+func (err *responseStartedError) Unwrap() error {
+	return err.err
+}
+
+// writeResponse writes the response header then pipes the response body,
+// returning a responseStartedError when piping the body fails.
+func writeResponse(w http.ResponseWriter, stream *wsp.Stream, httpResponse *wsp.HTTPResponse) error {
 	for header, values := range httpResponse.Header {
 		for _, value := range values {
 			w.Header().Add(header, value)
@@ -129,25 +357,54 @@ func (connection *Connection) proxyRequest(w http.ResponseWriter, r *http.Reques
 	}
 	w.WriteHeader(httpResponse.StatusCode)
 
-	responseBodyChannel := make(chan (io.Reader))
-	connection.nextResponse <- responseBodyChannel
-	responseBodyReader, ok := <-responseBodyChannel
-	if responseBodyReader == nil {
-		if ok {
-			close(responseChannel)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	buf := make([]byte, wsp.MaxFramePayload)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return &responseStartedError{fmt.Errorf("unable to pipe response body : %w", err)}
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &responseStartedError{fmt.Errorf("unable to read response body : %w", err)}
 		}
-		return fmt.Errorf("unable to get http response body reader : %w", err)
 	}
+}
 
-	if _, err := io.Copy(w, responseBodyReader); err != nil {
-		close(responseBodyChannel)
-		return fmt.Errorf("unable to pipe response body : %w", err)
+// hijacked returns conn, replaying what the hijacked bufio.Reader already
+// buffered so that reads keep going through conn.
+func hijacked(conn net.Conn, bufrw *bufio.ReadWriter) net.Conn {
+	if bufrw.Reader.Buffered() == 0 {
+		return conn
 	}
 
-	close(responseBodyChannel)
-	connection.Release()
+	buffered, _ := bufrw.Reader.Peek(bufrw.Reader.Buffered())
+	return &wsp.BufferedConn{
+		Conn:   conn,
+		Reader: bufio.NewReader(io.MultiReader(bytes.NewReader(buffered), conn)),
+	}
+}
 
-	return
+func writeSwitchingProtocols(conn net.Conn, header http.Header) error {
+	if _, err := io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"); err != nil {
+		return err
+	}
+	if err := header.Write(conn); err != nil {
+		return err
+	}
+	_, err := io.WriteString(conn, "\r\n")
+	return err
 }
 
 func (connection *Connection) Take() bool {
@@ -158,26 +415,32 @@ func (connection *Connection) Take() bool {
 		return false
 	}
 
-	if connection.status == Busy {
+	if connection.streams >= connection.maxStreams {
 		return false
 	}
 
+	connection.streams++
 	connection.status = Busy
 	return true
 }
 
+// Release gives back a stream and offers it to the requests waiting for a
+// connection, unless the connection is closed.
 func (connection *Connection) Release() {
 	connection.lock.Lock()
-	defer connection.lock.Unlock()
-
+	connection.streams--
 	if connection.status == Closed {
+		connection.lock.Unlock()
 		return
 	}
 
-	connection.idleSince = time.Now()
-	connection.status = Idle
+	if connection.streams == 0 {
+		connection.idleSince = time.Now()
+		connection.status = Idle
+	}
+	connection.lock.Unlock()
 
-	go connection.pool.Offer(connection)
+	connection.pool.server.offer(connection)
 }
 
 func (connection *Connection) Close() {
@@ -195,6 +458,7 @@ func (connection *Connection) close() {
 	log.Printf("Closing connection from %s", connection.pool.id)
 	defer func() { connection.status = Closed }()
 
-	close(connection.nextResponse)
-	connection.ws.Close()
+	connection.pool.server.metrics.disconnects.Inc()
+
+	connection.mux.Close()
 }
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+func (s *Server) listenForward(forward *Forward) error {
+	listener, err := net.Listen("tcp", forward.Listen)
+	if err != nil {
+		return err
+	}
+	s.listeners = append(s.listeners, listener)
+
+	log.Printf("Forwarding %s to %s", forward.Listen, forward.Destination)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-s.drain:
+				default:
+					log.Printf("Unable to accept on %s : %s", forward.Listen, err)
+				}
+				return
+			}
+
+			go s.forwardConnection(forward, conn)
+		}
+	}()
+
+	return nil
+}
+
+func (s *Server) forwardConnection(forward *Forward, conn net.Conn) {
+	defer conn.Close()
+
+	if s.draining() {
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(forward.Destination)
+	accept := andFilter(tunnelAccept(forward.Pool, host, port), selectorFilter(forward.selector))
+
+	if !s.hasPool(accept) {
+		log.Printf("No proxy available to forward %s to %s", conn.RemoteAddr(), forward.Destination)
+		return
+	}
+
+	connection := s.getConnection(context.Background(), forward.Destination, accept)
+	if connection == nil {
+		log.Printf("Unable to get a proxy connection to forward %s to %s", conn.RemoteAddr(), forward.Destination)
+		return
+	}
+
+	conn = &countingConn{Conn: conn, counter: s.metrics.bytes}
+	if err := connection.proxyDial(conn, forward.Destination); err != nil {
+		log.Println(err)
+	}
+}
+
+func poolFilter(poolID string) func(*Pool) bool {
+	return func(pool *Pool) bool {
+		return poolID == "" || pool.id == PoolID(poolID)
+	}
+}
+
+func tunnelAccept(poolID string, host string, port string) func(*Pool) bool {
+	filter := poolFilter(poolID)
+	return func(pool *Pool) bool {
+		return filter(pool) && pool.ServesAddress(host, port) && pool.HasCapability(wsp.CapabilityTunnel)
+	}
+}
+
+// forwardProxy hands CONNECT and absolute-form requests to Request when the
+// forward proxy is enabled. ServeMux cannot route them by path.
+func (s *Server) forwardProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.getConfig().ForwardProxy != nil && (r.Method == http.MethodConnect || r.URL.IsAbs()) {
+			s.Request(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) connect(w http.ResponseWriter, r *http.Request, caller *Caller) {
+	w, r, done := s.metrics.observe(w, r, http.StatusOK)
+	defer done()
+
+	config := s.getConfig()
+	if config.ForwardProxy == nil {
+		wsp.ProxyErrorCode(w, http.StatusMethodNotAllowed, fmt.Errorf("Forward proxy is disabled"))
+		return
+	}
+
+	if s.draining() {
+		wsp.ProxyErrorCode(w, http.StatusServiceUnavailable, fmt.Errorf("Server is shutting down"))
+		return
+	}
+
+	ctx, cancel, err := s.requestContext(r)
+	if err != nil {
+		wsp.ProxyErrorCode(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	address := r.Host
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		wsp.ProxyErrorCode(w, http.StatusBadRequest, fmt.Errorf("Invalid CONNECT address %s : %w", address, err))
+		return
+	}
+
+	log.Printf("[%s] %s", r.Method, address)
+
+	if !caller.AllowsAddress(host, port) {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : caller %s may not reach %s", caller.Name, address))
+		return
+	}
+
+	tunnelRequest := wsp.TunnelRequest(address, r.Header)
+	if err := wsp.CheckRules(tunnelRequest, config.Whitelist, config.Blacklist); err != nil {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : %w", err))
+		return
+	}
+
+	forward := andFilter(tunnelAccept(config.ForwardProxy.Pool, host, port), selectorFilter(config.ForwardProxy.selector))
+	tunnel := func(pool *Pool) bool { return forward(pool) && caller.AllowsPool(pool) }
+	if !s.hasPool(tunnel) {
+		wsp.ProxyErrorf(w, "No proxy available for destination %s", address)
+		return
+	}
+
+	accept := func(pool *Pool) bool { return tunnel(pool) && pool.CheckRules(tunnelRequest) == nil }
+	if !s.hasPool(accept) {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : no proxy pool allows %s %s", tunnelRequest.Method, tunnelRequest.URL))
+		return
+	}
+
+	session := s.sessionKey(r)
+	connection := s.getConnection(ctx, s.balancingKey(r), s.stick(session, accept))
+	if connection == nil {
+		proxyErrorContext(w, ctx, fmt.Errorf("Unable to get a proxy connection"))
+		return
+	}
+	s.pin(session, nil, connection.pool)
+
+	if err := connection.proxyConnect(w, r, address); err != nil {
+		proxyErrorContext(w, ctx, err)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/metrics"
+)
+
+type serverMetrics struct {
+	registry      *metrics.Registry
+	requests      *metrics.Counter
+	duration      *metrics.Histogram
+	dispatchWait  *metrics.Histogram
+	bytes         *metrics.Counter
+	registrations *metrics.Counter
+	disconnects   *metrics.Counter
+}
+
+func newServerMetrics(s *Server) (m *serverMetrics) {
+	m = new(serverMetrics)
+	m.registry = metrics.NewRegistry()
+
+	m.registry.NewGaugeFunc("wsp_pools", "Number of registered client pools.", nil, func() []metrics.Sample {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return []metrics.Sample{{Value: float64(len(s.pools))}}
+	})
+	m.registry.NewGaugeFunc("wsp_pool_connections", "Connections of each pool by state.", []string{"pool", "state"}, func() (samples []metrics.Sample) {
+		for _, pool := range s.getPools() {
+			ps := pool.Size()
+			id := string(pool.id)
+			samples = append(samples,
+				metrics.Sample{Labels: []string{id, "idle"}, Value: float64(ps.Idle)},
+				metrics.Sample{Labels: []string{id, "busy"}, Value: float64(ps.Busy)},
+				metrics.Sample{Labels: []string{id, "closed"}, Value: float64(ps.Closed)},
+			)
+		}
+		return
+	})
+	m.registry.NewGaugeFunc("wsp_pool_streams", "Streams in flight on each pool.", []string{"pool"}, func() (samples []metrics.Sample) {
+		for _, pool := range s.getPools() {
+			samples = append(samples, metrics.Sample{Labels: []string{string(pool.id)}, Value: float64(pool.Size().Streams)})
+		}
+		return
+	})
+
+	m.requests = m.registry.NewCounter("wsp_requests_total", "Proxied requests by response status code.", "code")
+	m.duration = m.registry.NewHistogram("wsp_request_duration_seconds", "Time to serve proxied requests.", metrics.DefaultBuckets)
+	m.dispatchWait = m.registry.NewHistogram("wsp_dispatch_wait_seconds", "Time spent waiting for a client connection.", metrics.DefaultBuckets, "result")
+	m.bytes = m.registry.NewCounter("wsp_bytes_total", "Bytes received from (in) and sent to (out) callers.", "direction")
+	m.registrations = m.registry.NewCounter("wsp_registrations_total", "Client registrations by result.", "result")
+	m.disconnects = m.registry.NewCounter("wsp_disconnects_total", "Client connections closed.")
+
+	return
+}
+
+// observe wraps w and the body of r to count bytes and the status code of
+// the proxied request. The returned function records it once served.
+func (m *serverMetrics) observe(w http.ResponseWriter, r *http.Request, hijackStatus int) (*responseRecorder, *http.Request, func()) {
+	start := time.Now()
+
+	recorder := &responseRecorder{ResponseWriter: w, metrics: m, hijackStatus: hijackStatus}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = &countingBody{ReadCloser: r.Body, counter: m.bytes}
+	}
+
+	return recorder, r, func() {
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.requests.Inc(strconv.Itoa(status))
+		m.duration.Observe(time.Since(start).Seconds())
+	}
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	metrics      *serverMetrics
+	status       int
+	hijackStatus int
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(p []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(p)
+	recorder.metrics.bytes.Add(float64(n), "out")
+	return n, err
+}
+
+func (recorder *responseRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (recorder *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if recorder.status == 0 {
+		recorder.status = recorder.hijackStatus
+	}
+	return &countingConn{Conn: conn, counter: recorder.metrics.bytes}, bufrw, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	counter *metrics.Counter
+}
+
+func (body *countingBody) Read(p []byte) (int, error) {
+	n, err := body.ReadCloser.Read(p)
+	body.counter.Add(float64(n), "in")
+	return n, err
+}
+
+type countingConn struct {
+	net.Conn
+	counter *metrics.Counter
+}
+
+func (conn *countingConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	conn.counter.Add(float64(n), "in")
+	return n, err
+}
+
+func (conn *countingConn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	conn.counter.Add(float64(n), "out")
+	return n, err
+}
+
+func (conn *countingConn) CloseWrite() error {
+	if hc, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
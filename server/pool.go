@@ -2,20 +2,28 @@ package server
 
 import (
 	"log"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
 type Pool struct {
-	server      *Server
-	id          PoolID
-	size        int
-	connections []*Connection
-	idle        chan *Connection
-	done        bool
-	lock        sync.Mutex
+	server       *Server
+	id           PoolID
+	size         int
+	maxSize      int
+	maxStreams   int
+	capabilities []string
+	labels       map[string]string
+	destinations []*wsp.Destination
+	connectedAt  time.Time
+	connections  []*Connection
+	done         bool
+	lock         sync.Mutex
 }
 
 type PoolID string
@@ -24,26 +32,95 @@ func NewPool(server *Server, id PoolID) *Pool {
 	p := new(Pool)
 	p.server = server
 	p.id = id
-	p.idle = make(chan *Connection)
+	p.connectedAt = time.Now()
 
 	return p
 }
 
-func (pool *Pool) Register(ws *websocket.Conn) {
+// Register adds a connection for ws to the pool and returns it, or nil
+// when the pool is shut down.
+func (pool *Pool) Register(ws *websocket.Conn, maxStreams int) *Connection {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
 
 	if pool.done {
-		return
+		return nil
 	}
 
 	log.Printf("Register new connection from %s", pool.id)
-	connection := NewConnection(pool, ws)
+	connection := NewConnection(pool, ws, maxStreams)
 	pool.connections = append(pool.connections, connection)
+	return connection
 }
 
-func (pool *Pool) Offer(connection *Connection) {
-	pool.idle <- connection
+func (pool *Pool) Serves(u *url.URL) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return wsp.MatchDestinations(pool.destinations, u)
+}
+
+func (pool *Pool) ServesAddress(host string, port string) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return wsp.MatchDestinationsHost(pool.destinations, host, port)
+}
+
+func (pool *Pool) HasCapability(capability string) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for _, c := range pool.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (pool *Pool) HasLabels(selector *Selector) bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return selector.Matches(pool.labels)
+}
+
+func (pool *Pool) CheckRules(r *http.Request) error {
+	rules := pool.server.getConfig().PoolRules[string(pool.id)]
+	if rules == nil {
+		return nil
+	}
+	return wsp.CheckRules(r, rules.Whitelist, rules.Blacklist)
+}
+
+// take takes a stream on the open connection of the pool with the fewest
+// streams in flight, or returns nil when all of them are full.
+func (pool *Pool) take() *Connection {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.done {
+		return nil
+	}
+
+	var candidate *Connection
+	streams := 0
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		free := connection.status != Closed && connection.streams < connection.maxStreams
+		n := connection.streams
+		connection.lock.Unlock()
+
+		if free && (candidate == nil || n < streams) {
+			candidate, streams = connection, n
+		}
+	}
+
+	if candidate != nil && candidate.Take() {
+		return candidate
+	}
+	return nil
 }
 
 func (pool *Pool) Clean() {
@@ -55,13 +132,14 @@ func (pool *Pool) Clean() {
 		if connection.status == Idle {
 			idle++
 			if idle > pool.size {
-				if int(time.Now().Sub(connection.idleSince).Seconds())*1000 > pool.server.Config.IdleTimeout {
+				if int(time.Now().Sub(connection.idleSince).Seconds())*1000 > pool.server.getConfig().IdleTimeout {
 					connection.close()
 				}
 			}
 		}
+		closed := connection.status == Closed
 		connection.lock.Unlock()
-		if connection.status == Closed {
+		if closed {
 			continue
 		}
 
@@ -78,6 +156,25 @@ func (pool *Pool) IsEmpty() bool {
 	return len(pool.connections) == 0
 }
 
+// IsConnected reports whether the pool still has an open connection.
+func (pool *Pool) IsConnected() bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.done {
+		return false
+	}
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		closed := connection.status == Closed
+		connection.lock.Unlock()
+		if !closed {
+			return true
+		}
+	}
+	return false
+}
+
 func (pool *Pool) Shutdown() {
 	pool.lock.Lock()
 	defer pool.lock.Unlock()
@@ -85,16 +182,58 @@ func (pool *Pool) Shutdown() {
 	pool.done = true
 
 	for _, connection := range pool.connections {
+		connection.mux.GoAway("connection pool shut down")
 		connection.Close()
 	}
 
 	pool.Clean()
 }
 
+// capacity returns the number of streams the client advertised it could
+// serve, at least 1.
+func (pool *Pool) capacity() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	size := pool.maxSize
+	if size < len(pool.connections) {
+		size = len(pool.connections)
+	}
+	streams := pool.maxStreams
+	if streams < 1 {
+		streams = 1
+	}
+	if size < 1 {
+		return streams
+	}
+	return size * streams
+}
+
+// load returns the share of the streams of the open connections in use.
+func (pool *Pool) load() float64 {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	streams, maxStreams := 0, 0
+	for _, connection := range pool.connections {
+		connection.lock.Lock()
+		if connection.status != Closed {
+			streams += connection.streams
+			maxStreams += connection.maxStreams
+		}
+		connection.lock.Unlock()
+	}
+	if maxStreams == 0 {
+		return 1
+	}
+	return float64(streams) / float64(maxStreams)
+}
+
 type PoolSize struct {
-	Idle   int
-	Busy   int
-	Closed int
+	Idle    int
+	Busy    int
+	Closed  int
+	Streams int
 }
 
 func (pool *Pool) Size() (ps *PoolSize) {
@@ -103,11 +242,16 @@ func (pool *Pool) Size() (ps *PoolSize) {
 
 	ps = new(PoolSize)
 	for _, connection := range pool.connections {
-		if connection.status == Idle {
+		connection.lock.Lock()
+		ps.Streams += connection.streams
+		status := connection.status
+		connection.lock.Unlock()
+
+		if status == Idle {
 			ps.Idle++
-		} else if connection.status == Busy {
+		} else if status == Busy {
 			ps.Busy++
-		} else if connection.status == Closed {
+		} else if status == Closed {
 			ps.Closed++
 		}
 	}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+// controlPaths are the endpoints of the main listener, which virtual hosts
+// never capture.
+var controlPaths = map[string]bool{
+	"/register": true,
+	"/request":  true,
+	"/status":   true,
+	"/metrics":  true,
+}
+
+// virtualHosts serves requests whose Host matches a reverse proxy route with a
+// Host as reverse proxy requests and everything else, including the control
+// paths, with next.
+func (s *Server) virtualHosts(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if controlPaths[path.Clean(r.URL.Path)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if route := s.route(r, true); route != nil {
+			s.reverseProxy(w, r, route)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) listenReverseProxy(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := s.route(r, false)
+		if route == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.reverseProxy(w, r, route)
+	}), ConnContext: connContext}
+	s.servers = append(s.servers, server)
+
+	log.Printf("Reverse proxy listening on %s", address)
+	go server.Serve(listener)
+
+	return nil
+}
+
+// reverseProxy sends r to the route destination on behalf of the caller it
+// authenticates, like Request does.
+func (s *Server) reverseProxy(w http.ResponseWriter, r *http.Request, route *Route) {
+	caller, err := s.authenticateCaller(r)
+	if err != nil {
+		proxyAuthRequired(w, err)
+		return
+	}
+
+	setForwardedHeaders(r)
+	r.URL = route.Rewrite(r.URL)
+
+	if !caller.AllowsURL(r.URL) {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : caller %s may not reach %s", caller.Name, r.URL.Host))
+		return
+	}
+
+	filter := selectorFilter(route.selector)
+	if caller != nil {
+		filter = andFilter(filter, caller.AllowsPool)
+	}
+
+	s.proxy(w, r, filter, route.selector != nil)
+}
+
+// route returns the route with the longest prefix matching r, preferring
+// routes bound to a Host for equal prefixes, and only considering those when
+// vhostOnly is set.
+func (s *Server) route(r *http.Request, vhostOnly bool) (match *Route) {
+	reverseProxy := s.getConfig().ReverseProxy
+	if reverseProxy == nil {
+		return nil
+	}
+
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, route := range reverseProxy.Routes {
+		if route.Host == "" && vhostOnly {
+			continue
+		}
+		if !route.MatchHost(host) || !route.MatchPath(r.URL.Path) {
+			continue
+		}
+		if match == nil || len(route.Prefix) > len(match.Prefix) ||
+			len(route.Prefix) == len(match.Prefix) && match.Host == "" && route.Host != "" {
+			match = route
+		}
+	}
+
+	return
+}
+
+func (route *Route) MatchHost(host string) bool {
+	if route.Host == "" {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(route.Host), host)
+	return ok
+}
+
+// MatchPath reports whether p is the route prefix or below it.
+func (route *Route) MatchPath(p string) bool {
+	if !strings.HasPrefix(p, route.Prefix) {
+		return false
+	}
+	return len(p) == len(route.Prefix) || strings.HasSuffix(route.Prefix, "/") || p[len(route.Prefix)] == '/'
+}
+
+// Rewrite maps u onto the route destination, replacing the route prefix by
+// the destination path and merging query strings.
+func (route *Route) Rewrite(u *url.URL) *url.URL {
+	rewritten := *route.destination
+
+	suffix := strings.TrimPrefix(u.Path, route.Prefix)
+	switch {
+	case suffix == "":
+		rewritten.Path = route.destination.Path
+	case strings.HasSuffix(rewritten.Path, "/") || strings.HasPrefix(suffix, "/"):
+		rewritten.Path = strings.TrimSuffix(rewritten.Path, "/") + "/" + strings.TrimPrefix(suffix, "/")
+	default:
+		rewritten.Path = rewritten.Path + "/" + suffix
+	}
+	rewritten.RawPath = ""
+
+	if rewritten.RawQuery == "" || u.RawQuery == "" {
+		rewritten.RawQuery = rewritten.RawQuery + u.RawQuery
+	} else {
+		rewritten.RawQuery = rewritten.RawQuery + "&" + u.RawQuery
+	}
+
+	return &rewritten
+}
+
+func setForwardedHeaders(r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		r.Header.Set("X-Forwarded-For", ip)
+	}
+
+	r.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		r.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		r.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
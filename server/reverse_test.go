@@ -0,0 +1,170 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func compileRoute(t *testing.T, route *Route) *Route {
+	t.Helper()
+
+	if err := route.Compile(); err != nil {
+		t.Fatalf("unable to compile route : %s", err)
+	}
+	return route
+}
+
+func TestRouteMatchPath(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		matches []string
+		rejects []string
+	}{
+		{prefix: "", matches: []string{"/", "/api", "/api/v1/"}},
+		{prefix: "/", matches: []string{"/", "/api", "/api/v1/"}},
+		{prefix: "/api", matches: []string{"/api", "/api/", "/api/v1"}, rejects: []string{"/", "/apis", "/ap", "/v1/api"}},
+		{prefix: "/api/", matches: []string{"/api/", "/api/v1"}, rejects: []string{"/api", "/apis"}},
+		{prefix: "/api/v1", matches: []string{"/api/v1", "/api/v1/users"}, rejects: []string{"/api", "/api/v10"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.prefix, func(t *testing.T) {
+			route := compileRoute(t, &Route{Prefix: test.prefix, Destination: "http://backend"})
+
+			for _, p := range test.matches {
+				if !route.MatchPath(p) {
+					t.Errorf("expected prefix %q to match %s", test.prefix, p)
+				}
+			}
+			for _, p := range test.rejects {
+				if route.MatchPath(p) {
+					t.Errorf("expected prefix %q not to match %s", test.prefix, p)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteMatchHost(t *testing.T) {
+	tests := []struct {
+		host    string
+		matches []string
+		rejects []string
+	}{
+		{host: "", matches: []string{"example.com", "localhost"}},
+		{host: "example.com", matches: []string{"example.com"}, rejects: []string{"www.example.com", "example.org"}},
+		{host: "Example.COM", matches: []string{"example.com"}},
+		{host: "*.example.com", matches: []string{"www.example.com", "api.example.com"}, rejects: []string{"example.com", "www.example.org"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.host, func(t *testing.T) {
+			route := compileRoute(t, &Route{Host: test.host, Destination: "http://backend"})
+
+			for _, host := range test.matches {
+				if !route.MatchHost(host) {
+					t.Errorf("expected host %q to match %s", test.host, host)
+				}
+			}
+			for _, host := range test.rejects {
+				if route.MatchHost(host) {
+					t.Errorf("expected host %q not to match %s", test.host, host)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefix      string
+		destination string
+		target      string
+		rewritten   string
+	}{
+		{name: "root", prefix: "/", destination: "http://backend", target: "/users", rewritten: "http://backend/users"},
+		{name: "root to path", prefix: "/", destination: "http://backend/app/", target: "/users", rewritten: "http://backend/app/users"},
+		{name: "prefix", prefix: "/api", destination: "http://backend", target: "/api/users", rewritten: "http://backend/users"},
+		{name: "prefix only", prefix: "/api", destination: "http://backend/v1", target: "/api", rewritten: "http://backend/v1"},
+		{name: "prefix to path", prefix: "/api", destination: "http://backend/v1", target: "/api/users", rewritten: "http://backend/v1/users"},
+		{name: "prefix to path with slash", prefix: "/api", destination: "http://backend/v1/", target: "/api/users", rewritten: "http://backend/v1/users"},
+		{name: "prefix with slash", prefix: "/api/", destination: "http://backend/v1", target: "/api/users", rewritten: "http://backend/v1/users"},
+		{name: "trailing slash", prefix: "/api", destination: "http://backend/v1", target: "/api/", rewritten: "http://backend/v1/"},
+		{name: "query", prefix: "/api", destination: "http://backend", target: "/api/users?page=2", rewritten: "http://backend/users?page=2"},
+		{name: "destination query", prefix: "/api", destination: "http://backend?key=secret", target: "/api/users", rewritten: "http://backend/users?key=secret"},
+		{name: "merged query", prefix: "/api", destination: "http://backend?key=secret", target: "/api/users?page=2", rewritten: "http://backend/users?key=secret&page=2"},
+		{name: "https and port", prefix: "/", destination: "https://backend:8443", target: "/users", rewritten: "https://backend:8443/users"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route := compileRoute(t, &Route{Prefix: test.prefix, Destination: test.destination})
+
+			target, err := url.Parse(test.target)
+			if err != nil {
+				t.Fatalf("unable to parse target : %s", err)
+			}
+			if rewritten := route.Rewrite(target).String(); rewritten != test.rewritten {
+				t.Fatalf("rewrote %s to %s, expected %s", test.target, rewritten, test.rewritten)
+			}
+			if route.destination.String() != test.destination {
+				t.Fatalf("rewrite modified the route destination to %s", route.destination)
+			}
+		})
+	}
+}
+
+func TestRouteInvalid(t *testing.T) {
+	for _, route := range []*Route{
+		{Prefix: "api", Destination: "http://backend"},
+		{Host: "[a-", Destination: "http://backend"},
+		{Destination: "backend"},
+		{Destination: "/path"},
+		{Destination: "http://backend", Selector: "env=pr od"},
+	} {
+		if err := route.Compile(); err == nil {
+			t.Errorf("expected route %+v to be invalid", route)
+		}
+	}
+}
+
+func TestServerRoute(t *testing.T) {
+	config := NewConfig()
+	config.ReverseProxy = &ReverseProxy{Routes: []*Route{
+		compileRoute(t, &Route{Destination: "http://default"}),
+		compileRoute(t, &Route{Prefix: "/api", Destination: "http://api"}),
+		compileRoute(t, &Route{Prefix: "/api/v2", Destination: "http://api-v2"}),
+		compileRoute(t, &Route{Host: "*.example.com", Destination: "http://example"}),
+		compileRoute(t, &Route{Host: "*.example.com", Prefix: "/api", Destination: "http://example-api"}),
+	}}
+	s := NewServer(config)
+	defer close(s.done)
+
+	tests := []struct {
+		target    string
+		vhostOnly bool
+		route     string
+	}{
+		{target: "http://localhost/", route: "http://default"},
+		{target: "http://localhost/api/users", route: "http://api"},
+		{target: "http://localhost/api/v2/users", route: "http://api-v2"},
+		{target: "http://localhost/api/v20", route: "http://api"},
+		{target: "http://www.example.com:8080/", route: "http://example"},
+		{target: "http://WWW.Example.com/api/users", route: "http://example-api"},
+		{target: "http://www.example.com/", vhostOnly: true, route: "http://example"},
+		{target: "http://localhost/api", vhostOnly: true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", test.target, nil)
+		route := s.route(r, test.vhostOnly)
+		switch {
+		case route == nil && test.route != "":
+			t.Errorf("no route for %s, expected %s", test.target, test.route)
+		case route != nil && route.Destination != test.route:
+			t.Errorf("routed %s to %s, expected %q", test.target, route.Destination, test.route)
+		}
+	}
+}
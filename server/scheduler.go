@@ -0,0 +1,123 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduler queues the requests waiting for a client connection. Requests
+// take a connection directly from the pools they accept when one has a free
+// stream, and otherwise wait in line until a connection is released or
+// registered and handed over to the first request accepting its pool.
+type scheduler struct {
+	lock    sync.Mutex
+	waiters *list.List
+}
+
+type waiter struct {
+	accept     func(*Pool) bool
+	connection chan *Connection
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{waiters: list.New()}
+}
+
+// getConnection returns a connection with a stream taken from a pool
+// accepted by accept, or nil when none is available before the dispatch
+// timeout, ctx is done or the server shuts down.
+func (s *Server) getConnection(ctx context.Context, key string, accept func(*Pool) bool) *Connection {
+	start := time.Now()
+
+	connection := s.waitConnection(ctx, key, s.affine(key, accept))
+
+	result := "ok"
+	if connection == nil {
+		result = "timeout"
+	}
+	s.metrics.dispatchWait.Observe(time.Since(start).Seconds(), result)
+
+	return connection
+}
+
+func (s *Server) waitConnection(ctx context.Context, key string, accept func(*Pool) bool) *Connection {
+	if connection := s.takeConnection(key, accept); connection != nil {
+		return connection
+	}
+
+	// Try again holding the scheduler lock so that a connection released in
+	// the meantime is either taken now or handed over once queued.
+	s.scheduler.lock.Lock()
+	if connection := s.takeConnection(key, accept); connection != nil {
+		s.scheduler.lock.Unlock()
+		return connection
+	}
+	w := &waiter{accept: accept, connection: make(chan *Connection, 1)}
+	element := s.scheduler.waiters.PushBack(w)
+	s.scheduler.lock.Unlock()
+
+	timer := time.NewTimer(s.getConfig().GetTimeout())
+	defer timer.Stop()
+
+	select {
+	case connection := <-w.connection:
+		return connection
+	case <-ctx.Done():
+	case <-timer.C:
+	case <-s.done:
+	}
+
+	s.scheduler.lock.Lock()
+	s.scheduler.waiters.Remove(element)
+	s.scheduler.lock.Unlock()
+
+	// A connection handed over while giving up goes back to the others.
+	select {
+	case connection := <-w.connection:
+		connection.Release()
+	default:
+	}
+	return nil
+}
+
+// takeConnection tries the pools accepted in the order of the configured
+// balancer and returns the first connection it could take a stream on.
+func (s *Server) takeConnection(key string, accept func(*Pool) bool) *Connection {
+	var pools []*Pool
+	s.lock.RLock()
+	for _, pool := range s.pools {
+		if accept(pool) {
+			pools = append(pools, pool)
+		}
+	}
+	s.lock.RUnlock()
+
+	for _, pool := range s.getConfig().getBalancer().Order(pools, key) {
+		if connection := pool.take(); connection != nil {
+			return connection
+		}
+	}
+	return nil
+}
+
+// offer hands the free streams of connection over to the waiting requests
+// accepting its pool, in the order they arrived.
+func (s *Server) offer(connection *Connection) {
+	s.scheduler.lock.Lock()
+	defer s.scheduler.lock.Unlock()
+
+	for element := s.scheduler.waiters.Front(); element != nil; {
+		next := element.Next()
+		w := element.Value.(*waiter)
+		if w.accept(connection.pool) {
+			if !connection.Take() {
+				return
+			}
+			s.scheduler.waiters.Remove(element)
+			w.connection <- connection
+		}
+		element = next
+	}
+}
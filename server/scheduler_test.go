@@ -0,0 +1,257 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Each pool has poolConnections connections of one stream, and callers
+// concurrent goroutines per CPU request a connection, hold it for holdTime
+// and release it. With more callers than connections, requests wait.
+const (
+	poolConnections = 2
+	holdTime        = 50 * time.Microsecond
+)
+
+var benchmarkCases = []struct {
+	pools   int
+	callers int
+}{
+	{10, 8},
+	{10, 64},
+	{1000, 64},
+	{5000, 256},
+}
+
+func BenchmarkDispatch(b *testing.B) {
+	for _, bc := range benchmarkCases {
+		b.Run(fmt.Sprintf("scheduler/pools=%d/callers=%d", bc.pools, bc.callers), func(b *testing.B) {
+			benchmarkScheduler(b, bc.pools, bc.callers)
+		})
+		b.Run(fmt.Sprintf("legacy/pools=%d/callers=%d", bc.pools, bc.callers), func(b *testing.B) {
+			benchmarkLegacy(b, bc.pools, bc.callers)
+		})
+	}
+}
+
+func benchmarkScheduler(b *testing.B, pools int, callers int) {
+	config := NewConfig()
+	config.Timeout = 10000
+	s := NewServer(config)
+	defer close(s.done)
+
+	for i := 0; i < pools; i++ {
+		pool := NewPool(s, PoolID(fmt.Sprintf("pool-%d", i)))
+		pool.maxStreams = 1
+		for j := 0; j < poolConnections; j++ {
+			connection := &Connection{pool: pool, status: Idle, maxStreams: 1}
+			pool.connections = append(pool.connections, connection)
+		}
+		s.pools = append(s.pools, pool)
+	}
+
+	accept := func(*Pool) bool { return true }
+	var failed int64
+
+	b.SetParallelism(callers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			connection := s.getConnection(context.Background(), "", accept)
+			if connection == nil {
+				atomic.AddInt64(&failed, 1)
+				continue
+			}
+			hold()
+			connection.Release()
+		}
+	})
+	b.StopTimer()
+
+	if failed > 0 {
+		b.Errorf("%d requests got no connection", failed)
+	}
+}
+
+func benchmarkLegacy(b *testing.B, pools int, callers int) {
+	d := newLegacyDispatcher()
+	defer close(d.done)
+
+	for i := 0; i < pools; i++ {
+		pool := &legacyPool{idle: make(chan *legacyConnection)}
+		for j := 0; j < poolConnections; j++ {
+			connection := &legacyConnection{pool: pool, maxStreams: 1}
+			connection.lock.Lock()
+			connection.offer()
+			connection.lock.Unlock()
+		}
+		d.pools = append(d.pools, pool)
+	}
+	go d.dispatchConnections()
+
+	accept := func(*legacyPool) bool { return true }
+	var failed int64
+
+	b.SetParallelism(callers)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			connection := d.getConnection(context.Background(), 10*time.Second, accept)
+			if connection == nil {
+				atomic.AddInt64(&failed, 1)
+				continue
+			}
+			hold()
+			connection.Release()
+		}
+	})
+	b.StopTimer()
+
+	if failed > 0 {
+		b.Errorf("%d requests got no connection", failed)
+	}
+}
+
+// hold stands for the time a request keeps its stream.
+func hold() {
+	for start := time.Now(); time.Since(start) < holdTime; {
+	}
+}
+
+// legacyDispatcher is the dispatcher the scheduler replaced : a single
+// goroutine serving connection requests one at a time by selecting over
+// the idle channels of the pools, on which each connection with a free
+// stream is offered by a goroutine of its own.
+type legacyDispatcher struct {
+	lock       sync.RWMutex
+	pools      []*legacyPool
+	dispatcher chan *legacyRequest
+	done       chan struct{}
+}
+
+type legacyPool struct {
+	idle chan *legacyConnection
+}
+
+type legacyConnection struct {
+	lock       sync.Mutex
+	pool       *legacyPool
+	streams    int
+	maxStreams int
+	offered    bool
+}
+
+type legacyRequest struct {
+	ctx        context.Context
+	timeout    time.Duration
+	connection chan *legacyConnection
+	accept     func(*legacyPool) bool
+}
+
+func newLegacyDispatcher() (d *legacyDispatcher) {
+	d = new(legacyDispatcher)
+	d.dispatcher = make(chan *legacyRequest)
+	d.done = make(chan struct{})
+	return
+}
+
+func (d *legacyDispatcher) dispatchConnections() {
+	for {
+		var request *legacyRequest
+		select {
+		case <-d.done:
+			return
+		case request = <-d.dispatcher:
+		}
+
+		ctx, cancel := context.WithTimeout(request.ctx, request.timeout)
+	L:
+		for {
+			select {
+			case <-ctx.Done():
+				break L
+			default:
+			}
+
+			d.lock.RLock()
+			if len(d.pools) == 0 {
+				d.lock.RUnlock()
+				break
+			}
+
+			var cases []reflect.SelectCase
+			for _, pool := range d.pools {
+				if !request.accept(pool) {
+					continue
+				}
+				cases = append(cases, reflect.SelectCase{
+					Dir:  reflect.SelectRecv,
+					Chan: reflect.ValueOf(pool.idle),
+				})
+			}
+			cases = append(cases, reflect.SelectCase{
+				Dir: reflect.SelectDefault,
+			})
+			d.lock.RUnlock()
+
+			_, value, ok := reflect.Select(cases)
+			if !ok {
+				continue
+			}
+			connection, _ := value.Interface().(*legacyConnection)
+			if connection.Take() {
+				request.connection <- connection
+				break
+			}
+		}
+		cancel()
+		close(request.connection)
+	}
+}
+
+func (d *legacyDispatcher) getConnection(ctx context.Context, timeout time.Duration, accept func(*legacyPool) bool) *legacyConnection {
+	request := &legacyRequest{ctx: ctx, timeout: timeout, connection: make(chan *legacyConnection), accept: accept}
+	select {
+	case <-d.done:
+		return nil
+	case d.dispatcher <- request:
+		return <-request.connection
+	}
+}
+
+func (connection *legacyConnection) Take() bool {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	connection.offered = false
+
+	if connection.streams >= connection.maxStreams {
+		return false
+	}
+
+	connection.streams++
+	connection.offer()
+	return true
+}
+
+func (connection *legacyConnection) Release() {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	connection.streams--
+	connection.offer()
+}
+
+func (connection *legacyConnection) offer() {
+	if connection.offered || connection.streams >= connection.maxStreams {
+		return
+	}
+
+	connection.offered = true
+	go func() { connection.pool.idle <- connection }()
+}
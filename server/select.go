@@ -0,0 +1,211 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+// selectPools returns a filter accepting the pools picked by the
+// X-PROXY-POOL and X-PROXY-SELECTOR headers, or nil when the request has
+// neither.
+func selectPools(r *http.Request) (filter func(*Pool) bool, err error) {
+	filter, err = poolPatterns(r.Header.Get("X-PROXY-POOL"))
+	if err != nil {
+		return nil, err
+	}
+
+	if header := r.Header.Get("X-PROXY-SELECTOR"); header != "" {
+		selector, err := ParseSelector(header)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid X-PROXY-SELECTOR header : %w", err)
+		}
+		filter = andFilter(filter, selectorFilter(selector))
+	}
+
+	return
+}
+
+// poolPatterns returns a filter accepting the pools whose ID matches one of
+// the comma separated patterns of header, or nil when header is empty.
+func poolPatterns(header string) (func(*Pool) bool, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	var patterns []string
+	for _, pattern := range strings.Split(header, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid X-PROXY-POOL pattern %q : %w", pattern, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("Empty X-PROXY-POOL header")
+	}
+
+	return func(pool *Pool) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, string(pool.id)); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// andFilter accepts the pools accepted by both filters, a nil filter
+// accepting any pool.
+func andFilter(a func(*Pool) bool, b func(*Pool) bool) func(*Pool) bool {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	return func(pool *Pool) bool { return a(pool) && b(pool) }
+}
+
+// Selector matches pool labels. It is a comma separated list of requirements
+// which must all hold : key=value, key!=value, key in (a,b), key notin (a,b),
+// key to require a label and !key to forbid it. Values may be empty, as label
+// values may.
+type Selector struct {
+	text         string
+	requirements []*requirement
+}
+
+type requirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+var setRequirement = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+
+func ParseSelector(text string) (selector *Selector, err error) {
+	selector = new(Selector)
+	selector.text = text
+
+	for _, term := range splitSelector(text) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, fmt.Errorf("empty requirement in selector %q", text)
+		}
+
+		req := new(requirement)
+		if match := setRequirement.FindStringSubmatch(term); match != nil {
+			req.key, req.operator = match[1], match[2]
+			for _, value := range strings.Split(match[3], ",") {
+				req.values = append(req.values, strings.TrimSpace(value))
+			}
+		} else if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+			req.key, req.operator = strings.TrimSpace(term[1:]), "!"
+		} else if i := strings.Index(term, "!="); i >= 0 {
+			req.key, req.operator, req.values = term[:i], "!=", []string{term[i+2:]}
+		} else if i := strings.Index(term, "=="); i >= 0 {
+			req.key, req.operator, req.values = term[:i], "=", []string{term[i+2:]}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			req.key, req.operator, req.values = term[:i], "=", []string{term[i+1:]}
+		} else {
+			req.key, req.operator = term, ""
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		if !wsp.ValidLabel(req.key) {
+			return nil, fmt.Errorf("invalid label key %q in selector %q", req.key, text)
+		}
+		for i, value := range req.values {
+			req.values[i] = strings.TrimSpace(value)
+			if !wsp.ValidLabelValue(req.values[i]) {
+				return nil, fmt.Errorf("invalid label value %q in selector %q", req.values[i], text)
+			}
+		}
+
+		selector.requirements = append(selector.requirements, req)
+	}
+
+	return
+}
+
+// splitSelector splits text on the commas outside of parentheses.
+func splitSelector(text string) (terms []string) {
+	depth := 0
+	start := 0
+	for i, c := range text {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, text[start:])
+}
+
+func (selector *Selector) Matches(labels map[string]string) bool {
+	for _, req := range selector.requirements {
+		if !req.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (req *requirement) matches(labels map[string]string) bool {
+	value, ok := labels[req.key]
+	switch req.operator {
+	case "":
+		return ok
+	case "!":
+		return !ok
+	case "=", "in":
+		return ok && req.has(value)
+	case "!=", "notin":
+		return !ok || !req.has(value)
+	}
+	return false
+}
+
+func (req *requirement) has(value string) bool {
+	for _, v := range req.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (selector *Selector) String() string {
+	return selector.text
+}
+
+// compileSelector parses text, an optional selector from the configuration.
+func compileSelector(text string) (*Selector, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return ParseSelector(text)
+}
+
+// selectorFilter accepts the pools whose labels match selector, or is nil
+// without selector.
+func selectorFilter(selector *Selector) func(*Pool) bool {
+	if selector == nil {
+		return nil
+	}
+	return func(pool *Pool) bool { return pool.HasLabels(selector) }
+}
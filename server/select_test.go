@@ -0,0 +1,108 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
+)
+
+func TestParseSelector(t *testing.T) {
+	prod := map[string]string{"env": "prod", "region": "eu-west"}
+	staging := map[string]string{"env": "staging", "region": "us-east", "canary": ""}
+	unlabeled := map[string]string{}
+	emptyEnv := map[string]string{"env": ""}
+
+	tests := []struct {
+		selector string
+		invalid  bool
+		matches  []map[string]string
+		rejects  []map[string]string
+	}{
+		{selector: "env=prod", matches: all(prod), rejects: all(staging, unlabeled, emptyEnv)},
+		{selector: "env==prod", matches: all(prod), rejects: all(staging, unlabeled)},
+		{selector: " env = prod ", matches: all(prod), rejects: all(staging)},
+		{selector: "env!=prod", matches: all(staging, unlabeled, emptyEnv), rejects: all(prod)},
+		{selector: "env in (prod, staging)", matches: all(prod, staging), rejects: all(unlabeled, emptyEnv)},
+		{selector: "env notin (prod,staging)", matches: all(unlabeled, emptyEnv), rejects: all(prod, staging)},
+		{selector: "env", matches: all(prod, staging, emptyEnv), rejects: all(unlabeled)},
+		{selector: "!env", matches: all(unlabeled), rejects: all(prod, staging, emptyEnv)},
+		{selector: "!canary", matches: all(prod, unlabeled), rejects: all(staging)},
+		{selector: "env=prod,region=eu-west", matches: all(prod), rejects: all(staging)},
+		{selector: "env in (prod,staging),!canary", matches: all(prod), rejects: all(staging, unlabeled)},
+		{selector: "region notin (us-east),env", matches: all(prod, emptyEnv), rejects: all(staging, unlabeled)},
+
+		// Empty values, as label values may be empty.
+		{selector: "env=", matches: all(emptyEnv), rejects: all(prod, unlabeled)},
+		{selector: "env!=", matches: all(prod, unlabeled), rejects: all(emptyEnv)},
+		{selector: "canary=", matches: all(staging), rejects: all(prod)},
+		{selector: "env in (,prod)", matches: all(prod, emptyEnv), rejects: all(staging, unlabeled)},
+		{selector: "env notin (,prod)", matches: all(staging, unlabeled), rejects: all(prod, emptyEnv)},
+
+		{selector: "", invalid: true},
+		{selector: "env=prod,", invalid: true},
+		{selector: ",env=prod", invalid: true},
+		{selector: "=prod", invalid: true},
+		{selector: "!", invalid: true},
+		{selector: "env=pr od", invalid: true},
+		{selector: "env=prod=eu", invalid: true},
+		{selector: "e nv", invalid: true},
+		{selector: "env in (prod,st aging)", invalid: true},
+		{selector: "env in prod", invalid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.selector, func(t *testing.T) {
+			selector, err := ParseSelector(test.selector)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected %q to be invalid", test.selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error : %s", err)
+			}
+
+			for _, labels := range test.matches {
+				if !selector.Matches(labels) {
+					t.Errorf("expected %q to match %v", test.selector, labels)
+				}
+			}
+			for _, labels := range test.rejects {
+				if selector.Matches(labels) {
+					t.Errorf("expected %q not to match %v", test.selector, labels)
+				}
+			}
+		})
+	}
+}
+
+// TestParseSelectorLabels checks that the pools of any valid set of labels
+// can be selected by their labels.
+func TestParseSelectorLabels(t *testing.T) {
+	for _, labels := range []map[string]string{
+		{"env": "prod"},
+		{"env": ""},
+		{"team.io/owner": "a-b_c"},
+		{"zone": "eu/west-1"},
+	} {
+		if err := wsp.ValidateLabels(labels); err != nil {
+			t.Fatalf("invalid labels %v : %s", labels, err)
+		}
+		for key, value := range labels {
+			for _, text := range []string{key + "=" + value, key + " in (" + value + ")", key} {
+				selector, err := ParseSelector(text)
+				if err != nil {
+					t.Fatalf("unable to select labels %v with %q : %s", labels, text, err)
+				}
+				if !selector.Matches(labels) {
+					t.Errorf("expected %q to match %v", text, labels)
+				}
+			}
+		}
+	}
+}
+
+func all(labels ...map[string]string) []map[string]string {
+	return labels
+}
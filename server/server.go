@@ -2,13 +2,15 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"reflect"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -16,24 +18,28 @@ import (
 	"github.com/hirasawayuki/reverse-proxy-websocket/wsp"
 )
 
+const handshakeTimeout = 10 * time.Second
+
+// Version is set at build time with -ldflags "-X ...server.Version=...".
+var Version = "dev"
+
 type Server struct {
 	Config     *Config
+	configLock sync.RWMutex
 	upgrader   websocket.Upgrader
 	pools      []*Pool
 	lock       sync.RWMutex
 	done       chan struct{}
-	dispatcher chan *ConnectionRequest
+	drain      chan struct{}
+	scheduler  *scheduler
 	server     *http.Server
-}
+	servers    []*http.Server
+	listeners  []net.Listener
+	metrics    *serverMetrics
+	startTime  time.Time
 
-type ConnectionRequest struct {
-	connection chan *Connection
-}
-
-func NewConnectionRequest(timeout time.Duration) (cr *ConnectionRequest) {
-	cr = new(ConnectionRequest)
-	cr.connection = make(chan *Connection)
-	return
+	revocations *revocationList
+	sessions    *sessionTable
 }
 
 func NewServer(config *Config) (server *Server) {
@@ -43,11 +49,18 @@ func NewServer(config *Config) (server *Server) {
 	server.Config = config
 	server.upgrader = websocket.Upgrader{}
 	server.done = make(chan struct{})
-	server.dispatcher = make(chan *ConnectionRequest)
+	server.drain = make(chan struct{})
+	server.scheduler = newScheduler()
+	server.metrics = newServerMetrics(server)
+	server.startTime = time.Now()
+	server.revocations = newRevocationList(config.RevocationList)
+	server.sessions = newSessionTable()
 	return
 }
 
 func (s *Server) Start() {
+	s.reloadRevocations()
+
 	go func() {
 	L:
 		for {
@@ -56,6 +69,8 @@ func (s *Server) Start() {
 				break L
 			case <-time.After(5 * time.Second):
 				s.clean()
+				s.sessions.Clean()
+				s.reloadRevocations()
 			}
 		}
 	}()
@@ -63,65 +78,93 @@ func (s *Server) Start() {
 	r := http.NewServeMux()
 	r.HandleFunc("/register", s.Register)
 	r.HandleFunc("/request", s.Request)
-	r.HandleFunc("/status", s.status)
+	r.Handle("/status", s.requireCaller(http.HandlerFunc(s.status)))
+	r.Handle("/metrics", s.requireCaller(s.metrics.registry))
 
-	go s.dispatchConnections()
 	s.server = &http.Server{
-		Addr:    s.Config.GetAddr(),
-		Handler: r,
+		Addr:        s.getConfig().GetAddr(),
+		Handler:     s.forwardProxy(s.virtualHosts(r)),
+		ConnContext: connContext,
 	}
 
-	go func() { log.Fatal(s.server.ListenAndServe()) }()
-}
+	s.servers = append(s.servers, s.server)
 
-func (s *Server) dispatchConnections() {
-	for {
-		request, ok := <-s.dispatcher
-		if !ok {
-			break
+	go func() {
+		var err error
+		if s.getConfig().TLS != nil {
+			s.server.TLSConfig = &tls.Config{GetConfigForClient: s.getTLSConfig}
+			err = s.server.ListenAndServeTLS("", "")
+		} else {
+			err = s.server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
 		}
+	}()
 
-		ctx := context.Background()
-		ctx, cancel := context.WithTimeout(ctx, s.Config.GetTimeout())
-		defer cancel()
-	L:
-		for {
-			select {
-			case <-ctx.Done():
-				break L
-			default:
-			}
+	if s.getConfig().ReverseProxy != nil && s.getConfig().ReverseProxy.Listen != "" {
+		if err := s.listenReverseProxy(s.getConfig().ReverseProxy.Listen); err != nil {
+			log.Printf("Unable to start reverse proxy on %s : %s", s.getConfig().ReverseProxy.Listen, err)
+		}
+	}
 
-			s.lock.RLock()
-			if len(s.pools) == 0 {
-				s.lock.RUnlock()
-				break
-			}
+	for _, forward := range s.getConfig().Forwards {
+		if err := s.listenForward(forward); err != nil {
+			log.Printf("Unable to forward %s to %s : %s", forward.Listen, forward.Destination, err)
+		}
+	}
+}
 
-			cases := make([]reflect.SelectCase, len(s.pools)+1)
-			for i, ch := range s.pools {
-				cases[i] = reflect.SelectCase{
-					Dir:  reflect.SelectRecv,
-					Chan: reflect.ValueOf(ch.idle),
-				}
-			}
-			cases[len(cases)-1] = reflect.SelectCase{
-				Dir: reflect.SelectDefault,
-			}
-			s.lock.RUnlock()
+// connContextKey is the request context key of the caller connection.
+type connContextKey struct{}
 
-			_, value, ok := reflect.Select(cases)
-			if !ok {
-				continue
-			}
-			connection, _ := value.Interface().(*Connection)
-			if connection.Take() {
-				request.connection <- connection
-				break
-			}
-		}
-		close(request.connection)
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+func (s *Server) getConfig() *Config {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	return s.Config
+}
+
+// getTLSConfig serves the certificates of the current configuration so they
+// can be rotated with Reload.
+func (s *Server) getTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if config := s.getConfig().TLS; config != nil {
+		return config.config, nil
+	}
+	return nil, fmt.Errorf("TLS is disabled")
+}
+
+// Reload applies config to the running server. Listeners are kept as they
+// are : changes to Host, Port, Forwards, the reverse proxy Listen address or
+// enabling TLS only take effect after a restart.
+func (s *Server) Reload(config *Config) {
+	s.configLock.Lock()
+	previous := s.Config
+	s.Config = config
+	s.configLock.Unlock()
+
+	if config.GetAddr() != previous.GetAddr() || (config.TLS == nil) != (previous.TLS == nil) {
+		log.Printf("Listen address and TLS mode changes require a restart")
+	}
+	if !reflect.DeepEqual(config.Forwards, previous.Forwards) || reverseProxyListen(config) != reverseProxyListen(previous) {
+		log.Printf("Forward and reverse proxy listener changes require a restart")
+	}
+
+	s.revocations.SetPath(config.RevocationList)
+	s.reloadRevocations()
+
+	log.Printf("Configuration reloaded")
+}
+
+func reverseProxyListen(config *Config) string {
+	if config.ReverseProxy == nil {
+		return ""
 	}
+	return config.ReverseProxy.Listen
 }
 
 func (s *Server) clean() {
@@ -153,7 +196,24 @@ func (s *Server) clean() {
 }
 
 func (s *Server) Request(w http.ResponseWriter, r *http.Request) {
+	caller, err := s.authenticateCaller(r)
+	if err != nil {
+		proxyAuthRequired(w, err)
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		s.connect(w, r, caller)
+		return
+	}
+
+	var filter func(*Pool) bool
 	dstURL := r.Header.Get("X-PROXY-DESTINATION")
+	if forwardProxy := s.getConfig().ForwardProxy; dstURL == "" && forwardProxy != nil && r.URL.IsAbs() {
+		dstURL = r.URL.String()
+		r.Header.Del("Proxy-Connection")
+		filter = andFilter(poolFilter(forwardProxy.Pool), selectorFilter(forwardProxy.selector))
+	}
 	if dstURL == "" {
 		wsp.ProxyErrorf(w, "Missing X-PROXY-DESTINATION header")
 		return
@@ -165,59 +225,242 @@ func (s *Server) Request(w http.ResponseWriter, r *http.Request) {
 	}
 	r.URL = URL
 
+	if !caller.AllowsURL(r.URL) {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : caller %s may not reach %s", caller.Name, r.URL.Host))
+		return
+	}
+
+	if caller != nil {
+		filter = andFilter(filter, caller.AllowsPool)
+	}
+
+	selection, err := selectPools(r)
+	if err != nil {
+		wsp.ProxyErrorCode(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.proxy(w, r, andFilter(filter, selection), selection != nil)
+}
+
+// proxy sends r, whose URL already points at the destination, through a
+// client connection from a pool accepted by filter, or any pool when nil.
+// When the caller selected the pools, it answers 503 if none of them has a
+// connection available.
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, filter func(*Pool) bool, selected bool) {
+	w, r, done := s.metrics.observe(w, r, http.StatusSwitchingProtocols)
+	defer done()
+
+	if s.draining() {
+		wsp.ProxyErrorCode(w, http.StatusServiceUnavailable, fmt.Errorf("Server is shutting down"))
+		return
+	}
+
+	if filter == nil {
+		filter = func(*Pool) bool { return true }
+	}
+
+	ctx, cancel, err := s.requestContext(r)
+	if err != nil {
+		wsp.ProxyErrorCode(w, http.StatusBadRequest, err)
+		return
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+
 	log.Printf("[%s] %s", r.Method, r.URL.String())
 
-	if len(s.pools) == 0 {
+	config := s.getConfig()
+	if err := wsp.CheckRules(r, config.Whitelist, config.Blacklist); err != nil {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : %w", err))
+		return
+	}
+
+	if !s.hasPool(filter) {
+		if selected {
+			wsp.ProxyErrorCode(w, http.StatusServiceUnavailable, fmt.Errorf("No proxy available in the selected pools"))
+			return
+		}
 		wsp.ProxyErrorf(w, "No proxy available")
 		return
 	}
 
-	request := NewConnectionRequest(s.Config.GetTimeout())
-	s.dispatcher <- request
-	connection := <-request.connection
+	serves := func(pool *Pool) bool { return filter(pool) && pool.Serves(r.URL) }
+	if !s.hasPool(serves) {
+		wsp.ProxyErrorf(w, "No proxy available for destination %s", r.URL.Host)
+		return
+	}
+
+	accept := func(pool *Pool) bool { return serves(pool) && pool.CheckRules(r) == nil }
+	if !s.hasPool(accept) {
+		wsp.ProxyErrorCode(w, http.StatusForbidden, fmt.Errorf("Forbidden request : no proxy pool allows %s %s", r.Method, r.URL))
+		return
+	}
+
+	upgrade := wsp.IsWebsocketUpgrade(r)
+	if upgrade {
+		allowed := accept
+		accept = func(pool *Pool) bool { return allowed(pool) && pool.HasCapability(wsp.CapabilityWebsocket) }
+		if !s.hasPool(accept) {
+			wsp.ProxyErrorf(w, "No proxy available for websocket destination %s", r.URL.Host)
+			return
+		}
+	}
+
+	session := s.sessionKey(r)
+	connection := s.getConnection(ctx, s.balancingKey(r), s.stick(session, accept))
 	if connection == nil {
-		wsp.ProxyErrorf(w, "Unable to get a proxy connection")
+		if selected && ctx.Err() == nil {
+			wsp.ProxyErrorCode(w, http.StatusServiceUnavailable, fmt.Errorf("No connection available in the selected pools"))
+			return
+		}
+		proxyErrorContext(w, ctx, fmt.Errorf("Unable to get a proxy connection"))
+		return
+	}
+
+	s.pin(session, nil, connection.pool)
+
+	if upgrade {
+		err = connection.proxyUpgrade(w, r)
+	} else {
+		err = connection.proxyRequest(w, r)
+		s.pin("", w.Header(), connection.pool)
+	}
+
+	var started *responseStartedError
+	if errors.As(err, &started) {
+		// The caller already got a status, abort its connection so that it
+		// does not take the truncated body for a complete one.
+		log.Printf("Unable to complete response from %s : %s", r.URL, err)
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		proxyErrorContext(w, ctx, err)
+	}
+}
+
+// requestContext bounds the request with the configured timeout or the one
+// requested in the X-PROXY-TIMEOUT header, capped by MaxRequestTimeout.
+func (s *Server) requestContext(r *http.Request) (ctx context.Context, cancel context.CancelFunc, err error) {
+	config := s.getConfig()
+	timeout := config.GetRequestTimeout()
+	if header := r.Header.Get("X-PROXY-TIMEOUT"); header != "" {
+		timeout, err = wsp.ParseTimeout(header)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to parse X-PROXY-TIMEOUT header : %w", err)
+		}
+	}
+
+	if max := config.GetMaxRequestTimeout(); max > 0 && (timeout <= 0 || timeout > max) {
+		timeout = max
+	}
+
+	if timeout <= 0 {
+		ctx, cancel = context.WithCancel(r.Context())
 		return
 	}
 
-	if err := connection.proxyRequest(w, r); err != nil {
-		log.Println(err)
-		connection.Close()
-		wsp.ProxyError(w, err)
+	ctx, cancel = context.WithTimeout(r.Context(), timeout)
+	return
+}
+
+func proxyErrorContext(w http.ResponseWriter, ctx context.Context, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		wsp.ProxyErrorCode(w, http.StatusGatewayTimeout, err)
+		return
 	}
+	wsp.ProxyError(w, err)
+}
+
+func (s *Server) getPools() []*Pool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return append([]*Pool(nil), s.pools...)
+}
+
+func (s *Server) hasPool(accept func(*Pool) bool) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, pool := range s.pools {
+		if accept(pool) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
-	secretKey := r.Header.Get("X-SECRET-KEY")
-	if secretKey != s.Config.SecretKey {
-		wsp.ProxyErrorf(w, "Invalid X-SECRET-KEY")
+	if s.draining() {
+		wsp.ProxyErrorCode(w, http.StatusServiceUnavailable, fmt.Errorf("Server is shutting down"))
 		return
 	}
 
-	ws, err := s.upgrader.Upgrade(w, r, nil)
+	tokenID, err := s.authenticate(r)
 	if err != nil {
-		wsp.ProxyErrorf(w, "HTTP upgrade error : %v", err)
+		s.metrics.registrations.Inc("unauthorized")
+		wsp.ProxyErrorCode(w, http.StatusUnauthorized, err)
 		return
 	}
 
-	_, greeting, err := ws.ReadMessage()
+	identity, err := s.clientIdentity(r)
 	if err != nil {
-		wsp.ProxyErrorf(w, "Unable to read greeting message : %s", err)
-		ws.Close()
+		s.metrics.registrations.Inc("unauthorized")
+		wsp.ProxyErrorCode(w, http.StatusForbidden, err)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("HTTP upgrade error : %v", err)
+		return
+	}
+
+	ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	greeting := new(wsp.Greeting)
+	if err := ws.ReadJSON(greeting); err != nil {
+		s.reject(ws, wsp.RejectGreeting("Unable to read greeting message : %s", err))
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	if err := greeting.Validate(); err != nil {
+		s.reject(ws, wsp.RejectGreeting("Invalid greeting message : %s", err))
 		return
 	}
 
-	split := strings.Split(string(greeting), "_")
-	id := PoolID(split[0])
-	size, err := strconv.Atoi(split[1])
+	if err := wsp.CheckVersion(greeting.Version); err != nil {
+		s.reject(ws, wsp.RejectGreeting("%s", err))
+		return
+	}
+
+	destinations, err := wsp.ParseDestinations(greeting.Destinations)
 	if err != nil {
-		wsp.ProxyErrorf(w, "Unable to parse greeting message : %s", err)
+		s.reject(ws, wsp.RejectGreeting("Invalid destinations : %s", err))
+		return
+	}
+
+	id := PoolID(greeting.ID)
+	if identity != "" {
+		id = PoolID(identity)
+	}
+	if tokenID != "" && PoolID(tokenID) != id {
+		s.reject(ws, wsp.RejectGreeting("Token was issued for %s, not %s", tokenID, id))
+		return
+	}
+	if s.revocations.Revoked(string(id)) {
+		s.reject(ws, wsp.RejectGreeting("Client %s is revoked", id))
+		return
+	}
+
+	if err := ws.WriteJSON(wsp.AcceptGreeting()); err != nil {
+		log.Printf("Unable to write greeting reply to %s : %s", greeting.ID, err)
 		ws.Close()
 		return
 	}
 
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
 	var pool *Pool
 	for _, p := range s.pools {
@@ -231,19 +474,114 @@ func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
 		s.pools = append(s.pools, pool)
 	}
 
-	pool.size = size
-	pool.Register(ws)
+	pool.lock.Lock()
+	pool.size = greeting.IdleSize
+	pool.maxSize = greeting.MaxSize
+	pool.maxStreams = greeting.MaxStreams
+	pool.capabilities = greeting.Capabilities
+	pool.labels = greeting.Labels
+	pool.destinations = destinations
+	pool.lock.Unlock()
+
+	s.metrics.registrations.Inc("accepted")
+	connection := pool.Register(ws, greeting.MaxStreams)
+	s.lock.Unlock()
+
+	if connection != nil {
+		s.offer(connection)
+	}
 }
 
-func (s *Server) status(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("ok"))
+// clientIdentity checks the certificate of a registering client when the TLS
+// configuration requires one and returns its common name when it is to be
+// used as the pool ID.
+func (s *Server) clientIdentity(r *http.Request) (string, error) {
+	config := s.getConfig().TLS
+	if config == nil || !config.RequireClientCert && !config.CertificateID {
+		return "", nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", fmt.Errorf("Client certificate required")
+	}
+	if !config.CertificateID {
+		return "", nil
+	}
+
+	identity := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if identity == "" {
+		return "", fmt.Errorf("Client certificate has no common name")
+	}
+	return identity, nil
 }
 
+func (s *Server) reject(ws *websocket.Conn, reply *wsp.GreetingReply) {
+	s.metrics.registrations.Inc("rejected")
+	log.Printf("Rejecting registration from %s : %s", ws.RemoteAddr(), reply.Reason)
+	if err := ws.WriteJSON(reply); err != nil {
+		log.Printf("Unable to write greeting reply : %s", err)
+	}
+	ws.Close()
+}
+
+func (s *Server) draining() bool {
+	select {
+	case <-s.drain:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown stops accepting requests and registrations, waits up to
+// ShutdownTimeout for the requests in flight to complete, then tells the
+// clients the server is going away and closes their connections.
 func (s *Server) Shutdown() {
+	close(s.drain)
+	timeout := s.getConfig().GetShutdownTimeout()
+	log.Printf("Draining, waiting up to %s for requests in flight", timeout)
+
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, server := range s.servers {
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Unable to drain HTTP server : %s", err)
+			server.Close()
+		}
+	}
+	s.waitStreams(ctx)
+
 	close(s.done)
-	close(s.dispatcher)
-	for _, pool := range s.pools {
+	for _, pool := range s.getPools() {
 		pool.Shutdown()
 	}
 	s.clean()
 }
+
+// waitStreams waits for every stream to complete or ctx to be done.
+func (s *Server) waitStreams(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		streams := 0
+		for _, pool := range s.getPools() {
+			streams += pool.Size().Streams
+		}
+		if streams == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Shutdown timeout expired with %d streams in flight", streams)
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"container/list"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionTable pins session keys to the pool that served them until they
+// expire, forgetting the least recently pinned ones beyond its size limit.
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[string]*list.Element
+	order    *list.List
+}
+
+type session struct {
+	key     string
+	pool    PoolID
+	expires time.Time
+}
+
+func newSessionTable() (table *sessionTable) {
+	table = new(sessionTable)
+	table.sessions = make(map[string]*list.Element)
+	table.order = list.New()
+	return
+}
+
+// Get returns the pool key is pinned to, if its session has not expired.
+func (table *sessionTable) Get(key string) (id PoolID, ok bool) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	element := table.sessions[key]
+	if element == nil {
+		return "", false
+	}
+	session := element.Value.(*session)
+	if time.Now().After(session.expires) {
+		return "", false
+	}
+	return session.pool, true
+}
+
+// Set pins key to the pool id for ttl, extending its session if it exists.
+// Beyond max sessions, the least recently pinned ones are forgotten.
+func (table *sessionTable) Set(key string, id PoolID, ttl time.Duration, max int) {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if element := table.sessions[key]; element != nil {
+		session := element.Value.(*session)
+		session.pool = id
+		session.expires = expires
+		table.order.MoveToBack(element)
+		return
+	}
+
+	table.sessions[key] = table.order.PushBack(&session{key: key, pool: id, expires: expires})
+	for table.order.Len() > max {
+		table.remove(table.order.Front())
+	}
+}
+
+// Clean forgets the expired sessions.
+func (table *sessionTable) Clean() {
+	table.lock.Lock()
+	defer table.lock.Unlock()
+
+	now := time.Now()
+	for element := table.order.Front(); element != nil; {
+		next := element.Next()
+		if now.After(element.Value.(*session).expires) {
+			table.remove(element)
+		}
+		element = next
+	}
+}
+
+func (table *sessionTable) remove(element *list.Element) {
+	delete(table.sessions, element.Value.(*session).key)
+	table.order.Remove(element)
+}
+
+// sessionKey returns the sticky session key of r, or an empty key when
+// sticky sessions are disabled or r carries none.
+func (s *Server) sessionKey(r *http.Request) string {
+	sticky := s.getConfig().StickySessions
+	if sticky == nil {
+		return ""
+	}
+	if sticky.Header != "" {
+		if key := r.Header.Get(sticky.Header); key != "" {
+			return "header:" + key
+		}
+	}
+	if sticky.Cookie != "" {
+		if cookie, err := r.Cookie(sticky.Cookie); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	return ""
+}
+
+// stick restricts accept to the pool the session key is pinned to, as long
+// as that pool is still connected and accepted. Otherwise the request falls
+// back to any pool accepted.
+func (s *Server) stick(key string, accept func(*Pool) bool) func(*Pool) bool {
+	if key == "" {
+		return accept
+	}
+	id, ok := s.sessions.Get(key)
+	if !ok {
+		return accept
+	}
+
+	pinned := func(pool *Pool) bool { return pool.id == id && accept(pool) }
+	if !s.hasPool(func(pool *Pool) bool { return pinned(pool) && pool.IsConnected() }) {
+		log.Printf("Session pool %s is gone, falling back to another pool", id)
+		return accept
+	}
+	return pinned
+}
+
+// pin pins the session key, and the session cookie set by the response
+// header if any, to pool.
+func (s *Server) pin(key string, header http.Header, pool *Pool) {
+	sticky := s.getConfig().StickySessions
+	if sticky == nil {
+		return
+	}
+
+	if key != "" {
+		s.sessions.Set(key, pool.id, sticky.GetTTL(), sticky.MaxSessions)
+	}
+
+	if sticky.Cookie == "" || header == nil {
+		return
+	}
+	for _, cookie := range (&http.Response{Header: header}).Cookies() {
+		if cookie.Name == sticky.Cookie && cookie.Value != "" && cookie.MaxAge >= 0 {
+			s.sessions.Set("cookie:"+cookie.Value, pool.id, sticky.GetTTL(), sticky.MaxSessions)
+		}
+	}
+}
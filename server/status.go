@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Status is the state of the server reported by /status.
+type Status struct {
+	Version   string
+	StartTime time.Time
+	Uptime    string
+	Pools     []*PoolStatus
+}
+
+type PoolStatus struct {
+	ID           PoolID
+	IdleSize     int
+	MaxSize      int
+	Capabilities []string
+	Labels       map[string]string
+	Destinations []string
+	ConnectedAt  time.Time
+	Size         *PoolSize
+	Connections  []*ConnectionStatus
+}
+
+type ConnectionStatus struct {
+	RemoteAddress string
+	ConnectedAt   time.Time
+	Status        string
+	Streams       int
+	MaxStreams    int
+	IdleFor       string
+}
+
+func (s *Server) getStatus() (status *Status) {
+	now := time.Now()
+
+	status = new(Status)
+	status.Version = Version
+	status.StartTime = s.startTime
+	status.Uptime = now.Sub(s.startTime).Round(time.Second).String()
+	status.Pools = []*PoolStatus{}
+
+	for _, pool := range s.getPools() {
+		status.Pools = append(status.Pools, pool.getStatus(now))
+	}
+
+	return
+}
+
+func (pool *Pool) getStatus(now time.Time) (status *PoolStatus) {
+	status = new(PoolStatus)
+	status.Size = pool.Size()
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	status.ID = pool.id
+	status.IdleSize = pool.size
+	status.MaxSize = pool.maxSize
+	status.Capabilities = pool.capabilities
+	status.Labels = pool.labels
+	status.ConnectedAt = pool.connectedAt
+	for _, destination := range pool.destinations {
+		status.Destinations = append(status.Destinations, destination.String())
+	}
+
+	status.Connections = []*ConnectionStatus{}
+	for _, connection := range pool.connections {
+		status.Connections = append(status.Connections, connection.getStatus(now))
+	}
+
+	return
+}
+
+func (connection *Connection) getStatus(now time.Time) (status *ConnectionStatus) {
+	connection.lock.Lock()
+	defer connection.lock.Unlock()
+
+	status = new(ConnectionStatus)
+	status.RemoteAddress = connection.remoteAddress
+	status.ConnectedAt = connection.connectedAt
+	status.Status = connection.status.String()
+	status.Streams = connection.streams
+	status.MaxStreams = connection.maxStreams
+	if connection.status == Idle {
+		status.IdleFor = now.Sub(connection.idleSince).Round(time.Second).String()
+	}
+	return
+}
+
+// status serves the server state as JSON, or as an HTML page when asked for
+// by a browser or with ?format=html.
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	status := s.getStatus()
+
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, status); err != nil {
+			log.Printf("Unable to render status page : %s", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(status); err != nil {
+		log.Printf("Unable to write status : %s", err)
+	}
+}
+
+func wantsHTML(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func sortedLabels(labels map[string]string) (pairs []string) {
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return
+}
+
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"labels": sortedLabels,
+	"join":   strings.Join,
+	"time":   func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>wsp_server status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+th { background: #eee; }
+.idle { color: #070; }
+.busy { color: #a60; }
+.closed { color: #a00; }
+</style>
+</head>
+<body>
+<h1>wsp_server</h1>
+<p>Version {{.Version}}, started {{time .StartTime}}, up {{.Uptime}}, {{len .Pools}} pool(s).</p>
+{{range .Pools}}
+<h2>{{.ID}}</h2>
+<table>
+<tr><th>Size</th><td>{{.IdleSize}} idle / {{.MaxSize}} max</td></tr>
+<tr><th>Connections</th><td>{{.Size.Idle}} idle, {{.Size.Busy}} busy, {{.Size.Closed}} closed, {{.Size.Streams}} streams</td></tr>
+<tr><th>Connected</th><td>{{time .ConnectedAt}}</td></tr>
+<tr><th>Labels</th><td>{{join (labels .Labels) ", "}}</td></tr>
+<tr><th>Capabilities</th><td>{{join .Capabilities ", "}}</td></tr>
+<tr><th>Destinations</th><td>{{join .Destinations ", "}}</td></tr>
+</table>
+<table>
+<tr><th>Remote address</th><th>Connected</th><th>Status</th><th>Streams</th><th>Idle for</th></tr>
+{{range .Connections}}<tr><td>{{.RemoteAddress}}</td><td>{{time .ConnectedAt}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{.Streams}} / {{.MaxStreams}}</td><td>{{.IdleFor}}</td></tr>
+{{end}}</table>
+{{else}}
+<p>No client connected.</p>
+{{end}}
+</body>
+</html>
+`))
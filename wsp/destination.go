@@ -0,0 +1,117 @@
+package wsp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Destination is a host pattern or CIDR a client advertises it can reach.
+//
+// Accepted forms are "10.0.0.0/8", "192.168.1.10", "db.internal",
+// "*.internal" and any of the host forms suffixed with ":port".
+type Destination struct {
+	pattern string
+	network *net.IPNet
+	host    string
+	port    string
+}
+
+func ParseDestination(pattern string) (destination *Destination, err error) {
+	destination = new(Destination)
+	destination.pattern = strings.TrimSpace(pattern)
+	if destination.pattern == "" {
+		return nil, fmt.Errorf("empty destination")
+	}
+
+	if _, network, e := net.ParseCIDR(destination.pattern); e == nil {
+		destination.network = network
+		return
+	}
+
+	host := destination.pattern
+	if h, p, e := net.SplitHostPort(host); e == nil {
+		host = h
+		destination.port = p
+	}
+	destination.host = strings.ToLower(host)
+
+	if _, err = path.Match(destination.host, ""); err != nil {
+		return nil, fmt.Errorf("invalid destination %q : %w", pattern, err)
+	}
+
+	return
+}
+
+func ParseDestinations(patterns []string) (destinations []*Destination, err error) {
+	for _, pattern := range patterns {
+		var destination *Destination
+		destination, err = ParseDestination(pattern)
+		if err != nil {
+			return nil, err
+		}
+		destinations = append(destinations, destination)
+	}
+	return
+}
+
+// Match reports whether the destination covers the host and port of u.
+func (destination *Destination) Match(u *url.URL) bool {
+	return destination.MatchHost(u.Hostname(), urlPort(u))
+}
+
+// MatchHost reports whether the destination covers host:port. Hostnames are
+// never resolved, so a CIDR only matches literal IP addresses.
+func (destination *Destination) MatchHost(host string, port string) bool {
+	host = strings.ToLower(host)
+
+	if destination.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && destination.network.Contains(ip)
+	}
+
+	if destination.port != "" && destination.port != port {
+		return false
+	}
+
+	ok, _ := path.Match(destination.host, host)
+	return ok
+}
+
+func (destination *Destination) String() string {
+	return destination.pattern
+}
+
+// MatchDestinations reports whether u is covered by one of destinations. An
+// empty list covers everything.
+func MatchDestinations(destinations []*Destination, u *url.URL) bool {
+	return MatchDestinationsHost(destinations, u.Hostname(), urlPort(u))
+}
+
+func MatchDestinationsHost(destinations []*Destination, host string, port string) bool {
+	if len(destinations) == 0 {
+		return true
+	}
+	for _, destination := range destinations {
+		if destination.MatchHost(host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+
+	switch u.Scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	}
+	return ""
+}
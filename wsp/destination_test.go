@@ -0,0 +1,129 @@
+package wsp
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestDestinationMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		rejects []string
+	}{
+		{
+			pattern: "10.0.0.0/8",
+			matches: []string{"http://10.1.2.3/", "https://10.255.255.255:8443/", "tcp://10.0.0.1:5432"},
+			rejects: []string{"http://11.0.0.1/", "http://10.internal/", "http://[::1]/"},
+		},
+		{
+			pattern: "192.168.1.10/32",
+			matches: []string{"http://192.168.1.10/"},
+			rejects: []string{"http://192.168.1.11/"},
+		},
+		{
+			pattern: "fd00::/8",
+			matches: []string{"http://[fd00::1]:8080/"},
+			rejects: []string{"http://[fe80::1]/", "http://10.0.0.1/"},
+		},
+		{
+			pattern: "192.168.1.10",
+			matches: []string{"http://192.168.1.10/", "https://192.168.1.10:8443/"},
+			rejects: []string{"http://192.168.1.100/"},
+		},
+		{
+			pattern: "db.internal",
+			matches: []string{"http://db.internal/", "http://DB.Internal:8080/"},
+			rejects: []string{"http://api.db.internal/", "http://db.internal.example.com/"},
+		},
+		{
+			pattern: "*.internal",
+			matches: []string{"http://api.internal/", "http://a.b.internal/", "wss://API.INTERNAL/ws"},
+			rejects: []string{"http://internal/", "http://api.internal.example.com/"},
+		},
+		{
+			pattern: "db.internal:5432",
+			matches: []string{"tcp://db.internal:5432"},
+			rejects: []string{"tcp://db.internal:5433", "http://db.internal/"},
+		},
+		{
+			pattern: "*.internal:443",
+			matches: []string{"https://api.internal/", "http://api.internal:443/", "wss://api.internal/"},
+			rejects: []string{"http://api.internal/", "ws://api.internal/"},
+		},
+		{
+			pattern: "[::1]:8080",
+			matches: []string{"http://[::1]:8080/"},
+			rejects: []string{"http://[::1]/", "http://127.0.0.1:8080/"},
+		},
+		{
+			pattern: "  Example.COM  ",
+			matches: []string{"http://example.com/"},
+			rejects: []string{"http://www.example.com/"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern, func(t *testing.T) {
+			destination, err := ParseDestination(test.pattern)
+			if err != nil {
+				t.Fatalf("unable to parse destination : %s", err)
+			}
+
+			for _, target := range test.matches {
+				if !destination.Match(parseURL(t, target)) {
+					t.Errorf("expected %q to match %s", test.pattern, target)
+				}
+			}
+			for _, target := range test.rejects {
+				if destination.Match(parseURL(t, target)) {
+					t.Errorf("expected %q not to match %s", test.pattern, target)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDestinationInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "   ", "[a-.internal", "db[.internal:80"} {
+		if _, err := ParseDestination(pattern); err == nil {
+			t.Errorf("expected %q to be invalid", pattern)
+		}
+	}
+
+	if _, err := ParseDestinations([]string{"10.0.0.0/8", ""}); err == nil {
+		t.Error("expected an invalid pattern to fail the list")
+	}
+}
+
+func TestMatchDestinations(t *testing.T) {
+	target := parseURL(t, "http://api.internal/")
+
+	if !MatchDestinations(nil, target) {
+		t.Error("expected an empty list to cover everything")
+	}
+
+	destinations, err := ParseDestinations([]string{"10.0.0.0/8", "db.internal"})
+	if err != nil {
+		t.Fatalf("unable to parse destinations : %s", err)
+	}
+	if MatchDestinations(destinations, target) {
+		t.Errorf("expected %v not to cover %s", destinations, target)
+	}
+	if !MatchDestinations(destinations, parseURL(t, "http://10.0.0.1/")) || !MatchDestinations(destinations, parseURL(t, "http://db.internal/")) {
+		t.Errorf("expected %v to cover each of its destinations", destinations)
+	}
+	if !MatchDestinationsHost(destinations, "db.internal", "5432") {
+		t.Errorf("expected %v to cover db.internal:5432", destinations)
+	}
+}
+
+func parseURL(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("unable to parse url %q : %s", rawURL, err)
+	}
+	return u
+}
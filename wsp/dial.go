@@ -0,0 +1,40 @@
+package wsp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DialRequest is the header of a FlagDial stream asking the client to open a
+// raw connection and pipe it to the stream.
+type DialRequest struct {
+	Network string
+	Address string
+}
+
+func NewDialRequest(address string) (dr *DialRequest, err error) {
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid dial address %q : %w", address, err)
+	}
+
+	dr = new(DialRequest)
+	dr.Network = "tcp"
+	dr.Address = address
+	return
+}
+
+// TunnelRequest is the request a tunnel to address is checked against the
+// rules as, by the server and the client alike : CONNECT tcp://host:port.
+func TunnelRequest(address string, header http.Header) *http.Request {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "tcp", Host: address},
+		Host:   address,
+		Header: header,
+	}
+}
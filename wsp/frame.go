@@ -0,0 +1,68 @@
+package wsp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+type FrameType byte
+
+const (
+	FrameOpen FrameType = iota + 1
+	FrameReply
+	FrameData
+	FrameEnd
+	FrameReset
+	FrameWindow
+)
+
+// Open frame flags.
+const (
+	FlagUpgrade byte = 1 << iota
+	FlagDial
+)
+
+const frameHeaderSize = 6
+
+// Frame is the unit carried by every binary websocket message once a
+// connection is registered : type, flags, stream id and payload.
+type Frame struct {
+	Type     FrameType
+	Flags    byte
+	StreamID uint32
+	Payload  []byte
+}
+
+func (frame *Frame) Marshal() []byte {
+	data := make([]byte, frameHeaderSize+len(frame.Payload))
+	data[0] = byte(frame.Type)
+	data[1] = frame.Flags
+	binary.BigEndian.PutUint32(data[2:frameHeaderSize], frame.StreamID)
+	copy(data[frameHeaderSize:], frame.Payload)
+	return data
+}
+
+func UnmarshalFrame(data []byte) (frame *Frame, err error) {
+	if len(data) < frameHeaderSize {
+		return nil, fmt.Errorf("frame too short : %d bytes", len(data))
+	}
+
+	frame = new(Frame)
+	frame.Type = FrameType(data[0])
+	frame.Flags = data[1]
+	frame.StreamID = binary.BigEndian.Uint32(data[2:frameHeaderSize])
+	frame.Payload = data[frameHeaderSize:]
+
+	if frame.Type < FrameOpen || frame.Type > FrameWindow {
+		return nil, fmt.Errorf("unknown frame type %d", frame.Type)
+	}
+	if frame.Type == FrameWindow && len(frame.Payload) != 4 {
+		return nil, fmt.Errorf("invalid window frame size %d", len(frame.Payload))
+	}
+
+	return
+}
+
+func (frame *Frame) String() string {
+	return fmt.Sprintf("frame type %d stream %d (%d bytes)", frame.Type, frame.StreamID, len(frame.Payload))
+}
@@ -0,0 +1,78 @@
+package wsp
+
+import (
+	"fmt"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken once a client
+// is registered. The handshake is an exact-match check : a server only
+// accepts clients speaking its own version, so servers and clients are
+// upgraded together whenever it changes.
+const ProtocolVersion = 3
+
+// Capabilities a client may advertise in its Greeting.
+const (
+	CapabilityWebsocket = "websocket"
+	CapabilityTunnel    = "tunnel"
+)
+
+// Greeting is the first message a client sends on a freshly registered
+// websocket.
+type Greeting struct {
+	Version      int
+	ID           string
+	IdleSize     int
+	MaxSize      int
+	MaxStreams   int
+	Capabilities []string
+	Labels       map[string]string
+	Destinations []string
+}
+
+func NewGreeting(id string) (greeting *Greeting) {
+	greeting = new(Greeting)
+	greeting.Version = ProtocolVersion
+	greeting.ID = id
+	greeting.Labels = make(map[string]string)
+	return
+}
+
+func (greeting *Greeting) Validate() error {
+	if greeting.ID == "" {
+		return fmt.Errorf("missing client id")
+	}
+	if greeting.IdleSize < 0 || greeting.MaxSize < 0 {
+		return fmt.Errorf("invalid pool size %d/%d", greeting.IdleSize, greeting.MaxSize)
+	}
+	if greeting.MaxStreams < 0 {
+		return fmt.Errorf("invalid max streams %d", greeting.MaxStreams)
+	}
+	if greeting.MaxSize > 0 && greeting.IdleSize > greeting.MaxSize {
+		return fmt.Errorf("idle size %d exceeds max size %d", greeting.IdleSize, greeting.MaxSize)
+	}
+	return ValidateLabels(greeting.Labels)
+}
+
+// GreetingReply is the server answer to a Greeting.
+type GreetingReply struct {
+	Accepted bool
+	Version  int
+	Reason   string
+}
+
+func AcceptGreeting() *GreetingReply {
+	return &GreetingReply{Accepted: true, Version: ProtocolVersion}
+}
+
+func RejectGreeting(format string, args ...interface{}) *GreetingReply {
+	return &GreetingReply{Reason: fmt.Sprintf(format, args...)}
+}
+
+// CheckVersion returns an error unless a peer speaking version speaks the
+// protocol version of this end.
+func CheckVersion(version int) error {
+	if version != ProtocolVersion {
+		return fmt.Errorf("unsupported protocol version %d, expected %d", version, ProtocolVersion)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package wsp
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var labelPattern = regexp.MustCompile(`^[A-Za-z0-9._/-]+$`)
+
+// ValidLabel reports whether s may be used as a label key or value. Keys and
+// values are kept to characters that need no quoting in a selector.
+func ValidLabel(s string) bool {
+	return labelPattern.MatchString(s)
+}
+
+// ValidLabelValue reports whether s may be used as a label value, which may
+// also be empty.
+func ValidLabelValue(s string) bool {
+	return s == "" || ValidLabel(s)
+}
+
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !ValidLabel(key) {
+			return fmt.Errorf("invalid label key %q", key)
+		}
+		if !ValidLabelValue(value) {
+			return fmt.Errorf("invalid value %q for label %s", value, key)
+		}
+	}
+	return nil
+}
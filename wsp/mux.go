@@ -0,0 +1,199 @@
+package wsp
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// StreamWindow is the number of bytes a peer may send on a stream before
+	// it has to wait for a window update.
+	StreamWindow    = 256 * 1024
+	MaxFramePayload = 32 * 1024
+
+	writeTimeout = 30 * time.Second
+)
+
+var ErrMuxClosed = errors.New("multiplexed connection closed")
+
+// Mux carries many concurrent streams over a single websocket. Streams are
+// opened by one side only : the server opens, the client accepts.
+type Mux struct {
+	ws        *websocket.Conn
+	accept    func(*Stream)
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	streams   map[uint32]*Stream
+	nextID    uint32
+	closed    bool
+	done      chan struct{}
+}
+
+func NewMux(ws *websocket.Conn, accept func(*Stream)) (mux *Mux) {
+	mux = new(Mux)
+	mux.ws = ws
+	mux.accept = accept
+	mux.streams = make(map[uint32]*Stream)
+	mux.done = make(chan struct{})
+	return
+}
+
+// Serve reads frames until the websocket fails or is closed.
+func (mux *Mux) Serve() (err error) {
+	defer mux.Close()
+
+	for {
+		var data []byte
+		_, data, err = mux.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var frame *Frame
+		frame, err = UnmarshalFrame(data)
+		if err != nil {
+			return
+		}
+
+		mux.dispatch(frame)
+	}
+}
+
+func (mux *Mux) dispatch(frame *Frame) {
+	if frame.Type == FrameOpen {
+		mux.open(frame)
+		return
+	}
+
+	stream := mux.get(frame.StreamID)
+	if stream == nil {
+		return
+	}
+
+	switch frame.Type {
+	case FrameReply:
+		stream.receiveReply(frame.Payload)
+	case FrameData:
+		stream.receiveData(frame.Payload)
+	case FrameEnd:
+		stream.receiveEnd()
+	case FrameReset:
+		stream.fail(&ResetError{Reason: string(frame.Payload)})
+		mux.remove(stream)
+	case FrameWindow:
+		stream.receiveWindow(int(binary.BigEndian.Uint32(frame.Payload)))
+	}
+}
+
+func (mux *Mux) open(frame *Frame) {
+	if mux.accept == nil {
+		mux.writeFrame(&Frame{Type: FrameReset, StreamID: frame.StreamID, Payload: []byte("streams not accepted")})
+		return
+	}
+
+	stream := newStream(mux, frame.StreamID, frame.Flags, frame.Payload)
+
+	mux.lock.Lock()
+	if mux.closed {
+		mux.lock.Unlock()
+		return
+	}
+	if _, ok := mux.streams[stream.id]; ok {
+		mux.lock.Unlock()
+		return
+	}
+	mux.streams[stream.id] = stream
+	mux.lock.Unlock()
+
+	go mux.accept(stream)
+}
+
+// Open starts a new stream, sending header and flags to the peer.
+func (mux *Mux) Open(flags byte, header []byte) (stream *Stream, err error) {
+	mux.lock.Lock()
+	if mux.closed {
+		mux.lock.Unlock()
+		return nil, ErrMuxClosed
+	}
+	mux.nextID++
+	stream = newStream(mux, mux.nextID, flags, header)
+	mux.streams[stream.id] = stream
+	mux.lock.Unlock()
+
+	err = mux.writeFrame(&Frame{Type: FrameOpen, Flags: flags, StreamID: stream.id, Payload: header})
+	if err != nil {
+		mux.remove(stream)
+		return nil, err
+	}
+
+	return
+}
+
+func (mux *Mux) get(id uint32) *Stream {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	return mux.streams[id]
+}
+
+func (mux *Mux) remove(stream *Stream) {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	if mux.streams[stream.id] == stream {
+		delete(mux.streams, stream.id)
+	}
+}
+
+func (mux *Mux) writeFrame(frame *Frame) (err error) {
+	mux.writeLock.Lock()
+	defer mux.writeLock.Unlock()
+
+	mux.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err = mux.ws.WriteMessage(websocket.BinaryMessage, frame.Marshal())
+	if err != nil {
+		go mux.Close()
+	}
+	return
+}
+
+func (mux *Mux) NumStreams() int {
+	mux.lock.Lock()
+	defer mux.lock.Unlock()
+
+	return len(mux.streams)
+}
+
+func (mux *Mux) Done() <-chan struct{} {
+	return mux.done
+}
+
+// GoAway sends a going away close frame with reason before closing the mux.
+func (mux *Mux) GoAway(reason string) {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+	mux.ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	mux.Close()
+}
+
+// Close fails every open stream and closes the websocket.
+func (mux *Mux) Close() {
+	mux.lock.Lock()
+	if mux.closed {
+		mux.lock.Unlock()
+		return
+	}
+	mux.closed = true
+	streams := mux.streams
+	mux.streams = make(map[uint32]*Stream)
+	close(mux.done)
+	mux.lock.Unlock()
+
+	for _, stream := range streams {
+		stream.fail(ErrMuxClosed)
+	}
+	mux.ws.Close()
+}
@@ -0,0 +1,354 @@
+package wsp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testTimeout = 5 * time.Second
+
+// muxPair is a Mux opening streams, like the server one, connected over a
+// real websocket to a Mux accepting them, like the client one.
+type muxPair struct {
+	opener   *Mux
+	acceptor *Mux
+	accepted chan *Stream
+}
+
+func newMuxPair(t *testing.T) (pair *muxPair) {
+	t.Helper()
+
+	pair = new(muxPair)
+	pair.accepted = make(chan *Stream, 16)
+
+	upgrader := websocket.Upgrader{}
+	opener := make(chan *Mux, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("unable to upgrade : %s", err)
+			return
+		}
+		mux := NewMux(ws, nil)
+		opener <- mux
+		mux.Serve()
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("unable to dial : %s", err)
+	}
+	pair.acceptor = NewMux(ws, func(stream *Stream) { pair.accepted <- stream })
+	go pair.acceptor.Serve()
+	pair.opener = <-opener
+
+	t.Cleanup(func() {
+		pair.opener.Close()
+		pair.acceptor.Close()
+	})
+	return
+}
+
+// open opens a stream and returns both of its ends.
+func (pair *muxPair) open(t *testing.T) (opened *Stream, accepted *Stream) {
+	t.Helper()
+
+	opened, err := pair.opener.Open(0, []byte("header"))
+	if err != nil {
+		t.Fatalf("unable to open stream : %s", err)
+	}
+
+	select {
+	case accepted = <-pair.accepted:
+	case <-time.After(testTimeout):
+		t.Fatal("stream not accepted")
+	}
+	if accepted.ID() != opened.ID() || string(accepted.Header()) != "header" {
+		t.Fatalf("accepted stream %d with header %q, expected %d with header %q", accepted.ID(), accepted.Header(), opened.ID(), "header")
+	}
+	return
+}
+
+func readAll(t *testing.T, stream *Stream) (data []byte, err error) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		data, err = io.ReadAll(stream)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("stream %d read did not end", stream.ID())
+	}
+	return
+}
+
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(testTimeout); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	pair := newMuxPair(t)
+	opened, accepted := pair.open(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (StreamWindow+MaxFramePayload)/16)
+	written := make(chan error, 1)
+	go func() {
+		_, err := opened.Write(data)
+		if err == nil {
+			err = opened.CloseWrite()
+		}
+		written <- err
+	}()
+
+	// Nothing is read yet : the writer stops once the window is exhausted.
+	waitFor(t, "the window to be exhausted", func() bool {
+		opened.lock.Lock()
+		defer opened.lock.Unlock()
+		return opened.window == 0
+	})
+	waitFor(t, "the window to be received", func() bool {
+		accepted.lock.Lock()
+		defer accepted.lock.Unlock()
+		return accepted.buffer.Len() == StreamWindow
+	})
+	select {
+	case err := <-written:
+		t.Fatalf("write returned with the window exhausted : %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Reading sends window updates and the writer resumes.
+	received, err := readAll(t, accepted)
+	if err != nil {
+		t.Fatalf("unable to read : %s", err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatalf("unable to write : %s", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("write did not resume")
+	}
+	if !bytes.Equal(received, data) {
+		t.Fatalf("received %d bytes, expected the %d bytes written", len(received), len(data))
+	}
+}
+
+func TestStreamWindowExceeded(t *testing.T) {
+	pair := newMuxPair(t)
+	opened, _ := pair.open(t)
+
+	// Send more than the window without waiting for updates, as Write would.
+	chunk := make([]byte, MaxFramePayload)
+	for sent := 0; sent <= StreamWindow; sent += len(chunk) {
+		if err := pair.opener.writeFrame(&Frame{Type: FrameData, StreamID: opened.ID(), Payload: chunk}); err != nil {
+			t.Fatalf("unable to write frame : %s", err)
+		}
+	}
+
+	_, err := readAll(t, opened)
+	var reset *ResetError
+	if !errors.As(err, &reset) || !strings.Contains(reset.Reason, "window") {
+		t.Fatalf("got %v, expected the peer to reset the stream for exceeding the window", err)
+	}
+}
+
+func TestStreamEndAndReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(*Stream) error
+		reset  string
+	}{
+		{name: "end", finish: (*Stream).CloseWrite},
+		{name: "reset", finish: func(stream *Stream) error { return stream.Reset("aborted") }, reset: "aborted"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pair := newMuxPair(t)
+			opened, accepted := pair.open(t)
+
+			if err := accepted.Reply([]byte("reply")); err != nil {
+				t.Fatalf("unable to reply : %s", err)
+			}
+			if _, err := accepted.Write([]byte("partial body")); err != nil {
+				t.Fatalf("unable to write : %s", err)
+			}
+			if err := test.finish(accepted); err != nil {
+				t.Fatalf("unable to finish : %s", err)
+			}
+
+			reply, err := opened.ReadReply()
+			if err != nil || string(reply) != "reply" {
+				t.Fatalf("got reply %q, %v, expected %q", reply, err, "reply")
+			}
+
+			// Data sent before End or Reset is delivered before either.
+			body, err := readAll(t, opened)
+			if string(body) != "partial body" {
+				t.Fatalf("got body %q, expected %q", body, "partial body")
+			}
+
+			if test.reset == "" {
+				if err != nil {
+					t.Fatalf("got %v, expected the body to end cleanly", err)
+				}
+				return
+			}
+			var reset *ResetError
+			if !errors.As(err, &reset) || reset.Reason != test.reset {
+				t.Fatalf("got %v, expected a reset with reason %q", err, test.reset)
+			}
+		})
+	}
+}
+
+func TestStreamCloseWrite(t *testing.T) {
+	pair := newMuxPair(t)
+	opened, accepted := pair.open(t)
+
+	if _, err := opened.Write([]byte("request")); err != nil {
+		t.Fatalf("unable to write : %s", err)
+	}
+	if err := opened.CloseWrite(); err != nil {
+		t.Fatalf("unable to close write : %s", err)
+	}
+	if _, err := opened.Write([]byte("late")); err != ErrStreamClosed {
+		t.Fatalf("write after close write got %v, expected %v", err, ErrStreamClosed)
+	}
+
+	// The peer reads up to the end and can still answer.
+	request, err := readAll(t, accepted)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("got request %q, %v, expected %q", request, err, "request")
+	}
+	if _, err := accepted.Write([]byte("response")); err != nil {
+		t.Fatalf("unable to write after the peer closed : %s", err)
+	}
+	if err := accepted.CloseWrite(); err != nil {
+		t.Fatalf("unable to close write : %s", err)
+	}
+
+	response, err := readAll(t, opened)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("got response %q, %v, expected %q", response, err, "response")
+	}
+
+	// Both directions are done : both ends forget the stream.
+	waitFor(t, "the stream to be removed", func() bool {
+		return pair.opener.NumStreams() == 0 && pair.acceptor.NumStreams() == 0
+	})
+}
+
+func TestMuxClose(t *testing.T) {
+	pair := newMuxPair(t)
+	opened, accepted := pair.open(t)
+
+	replied := make(chan error, 1)
+	go func() {
+		_, err := opened.ReadReply()
+		replied <- err
+	}()
+
+	pair.opener.Close()
+
+	select {
+	case err := <-replied:
+		if err != ErrMuxClosed {
+			t.Fatalf("pending read reply got %v, expected %v", err, ErrMuxClosed)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("pending read reply not failed")
+	}
+	if _, err := opened.Write([]byte("data")); err != ErrMuxClosed {
+		t.Fatalf("write got %v, expected %v", err, ErrMuxClosed)
+	}
+	if _, err := pair.opener.Open(0, nil); err != ErrMuxClosed {
+		t.Fatalf("open got %v, expected %v", err, ErrMuxClosed)
+	}
+	select {
+	case <-pair.opener.Done():
+	default:
+		t.Fatal("closed mux not done")
+	}
+
+	// The peer loses the websocket and fails its streams as well.
+	select {
+	case <-accepted.Context().Done():
+	case <-time.After(testTimeout):
+		t.Fatal("peer stream context not canceled")
+	}
+	if _, err := readAll(t, accepted); err != ErrMuxClosed {
+		t.Fatalf("peer read got %v, expected %v", err, ErrMuxClosed)
+	}
+}
+
+func TestMuxUnknownStream(t *testing.T) {
+	pair := newMuxPair(t)
+
+	// Frames for a stream the peer does not know are dropped.
+	for _, frame := range []*Frame{
+		{Type: FrameReply, StreamID: 42, Payload: []byte("stray")},
+		{Type: FrameData, StreamID: 42, Payload: []byte("stray")},
+		{Type: FrameWindow, StreamID: 42, Payload: []byte{0, 0, 1, 0}},
+		{Type: FrameEnd, StreamID: 42},
+		{Type: FrameReset, StreamID: 42, Payload: []byte("stray")},
+	} {
+		if err := pair.opener.writeFrame(frame); err != nil {
+			t.Fatalf("unable to write %s : %s", frame, err)
+		}
+	}
+
+	// And the websocket keeps carrying streams.
+	opened, accepted := pair.open(t)
+	if _, err := opened.Write([]byte("data")); err != nil {
+		t.Fatalf("unable to write : %s", err)
+	}
+	opened.CloseWrite()
+	data, err := readAll(t, accepted)
+	if err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v, expected %q", data, err, "data")
+	}
+	if n := pair.acceptor.NumStreams(); n != 1 {
+		t.Fatalf("peer has %d streams, expected 1", n)
+	}
+}
+
+func TestMuxOpenNotAccepted(t *testing.T) {
+	pair := newMuxPair(t)
+
+	// The opener does not accept streams : it resets the ones opened to it.
+	stream, err := pair.acceptor.Open(0, []byte("header"))
+	if err != nil {
+		t.Fatalf("unable to open stream : %s", err)
+	}
+	timer := time.AfterFunc(testTimeout, func() { stream.Reset("timed out") })
+	defer timer.Stop()
+
+	_, err = stream.ReadReply()
+	var reset *ResetError
+	if !errors.As(err, &reset) {
+		t.Fatalf("got %v, expected the stream to be reset", err)
+	}
+}
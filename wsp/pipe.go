@@ -0,0 +1,79 @@
+package wsp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+)
+
+type halfCloser interface {
+	CloseWrite() error
+}
+
+// BufferedConn is a net.Conn whose reads go through a bufio.Reader that may
+// already hold data, like the ones returned by http.Hijacker or left over
+// by http.ReadResponse.
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (conn *BufferedConn) Read(p []byte) (int, error) {
+	return conn.Reader.Read(p)
+}
+
+func (conn *BufferedConn) CloseWrite() error {
+	if hc, ok := conn.Conn.(halfCloser); ok {
+		return hc.CloseWrite()
+	}
+	return conn.Conn.Close()
+}
+
+// Join copies bytes both ways between stream and conn until both directions
+// are done or one of them fails, then closes both.
+func Join(stream *Stream, conn io.ReadWriteCloser) (err error) {
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(conn, stream)
+		if err == nil {
+			if hc, ok := conn.(halfCloser); ok {
+				err = hc.CloseWrite()
+			} else {
+				err = conn.Close()
+			}
+		}
+		errs <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(stream, conn)
+		if err == nil {
+			err = stream.CloseWrite()
+		}
+		errs <- err
+	}()
+
+	for i := 0; i < 2; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			conn.Close()
+			stream.Reset(e.Error())
+		}
+	}
+
+	conn.Close()
+	stream.Close()
+	return
+}
+
+// DialAddress returns the host:port to dial for u, using the scheme default
+// port when u has none.
+func DialAddress(u *url.URL) string {
+	return net.JoinHostPort(u.Hostname(), urlPort(u))
+}
+
+func IsTLS(u *url.URL) bool {
+	return u.Scheme == "https" || u.Scheme == "wss"
+}
@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type HTTPRequest struct {
@@ -12,6 +15,7 @@ type HTTPRequest struct {
 	URL           string
 	Header        map[string][]string
 	ContentLength int64
+	Timeout       time.Duration
 }
 
 func SerializeHTTPRequest(req *http.Request) (r *HTTPRequest) {
@@ -20,6 +24,9 @@ func SerializeHTTPRequest(req *http.Request) (r *HTTPRequest) {
 	r.Method = req.Method
 	r.Header = req.Header
 	r.ContentLength = req.ContentLength
+	if deadline, ok := req.Context().Deadline(); ok {
+		r.Timeout = time.Until(deadline)
+	}
 	return
 }
 
@@ -36,6 +43,40 @@ func UnserializeHTTPRequest(req *HTTPRequest) (r *http.Request, err error) {
 	return
 }
 
+// ParseTimeout accepts a Go duration ("1m30s") or a number of milliseconds.
+func ParseTimeout(value string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(value); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("negative timeout %d", ms)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("negative timeout %s", timeout)
+	}
+	return timeout, nil
+}
+
+func IsWebsocketUpgrade(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 type Rule struct {
 	Method  string
 	URL     string
@@ -49,7 +90,7 @@ type Rule struct {
 func NewRule(method string, url string, headers map[string]string) (rule *Rule, err error) {
 	rule = new(Rule)
 	rule.Method = method
-	rule.URL = method
+	rule.URL = url
 	if headers != nil {
 		rule.Headers = headers
 	} else {
@@ -106,3 +147,37 @@ func (rule *Rule) Match(req *http.Request) bool {
 func (rule *Rule) String() string {
 	return fmt.Sprintf("%s %s %v", rule.Method, rule.URL, rule.Headers)
 }
+
+func CompileRules(rules []*Rule) (err error) {
+	for _, rule := range rules {
+		if err = rule.Compile(); err != nil {
+			return fmt.Errorf("invalid rule %s : %w", rule, err)
+		}
+	}
+	return
+}
+
+// CheckRules returns an error unless req matches at least one whitelist rule
+// (when any are set) and none of the blacklist rules.
+func CheckRules(req *http.Request, whitelist []*Rule, blacklist []*Rule) error {
+	if len(whitelist) > 0 {
+		allowed := false
+		for _, rule := range whitelist {
+			if rule.Match(req) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s %s does not match any whitelist rule", req.Method, req.URL)
+		}
+	}
+
+	for _, rule := range blacklist {
+		if rule.Match(req) {
+			return fmt.Errorf("%s %s is blacklisted by rule %s", req.Method, req.URL, rule)
+		}
+	}
+
+	return nil
+}
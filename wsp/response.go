@@ -15,7 +15,7 @@ type HTTPResponse struct {
 func SerializeHTTPResponse(resp *http.Response) (r *HTTPResponse) {
 	r = new(HTTPResponse)
 	r.StatusCode = resp.StatusCode
-	r.Header = make(http.Header)
+	r.Header = resp.Header
 	r.ContentLength = resp.ContentLength
 	return
 }
@@ -27,8 +27,12 @@ func NewHTTPResponse() (r *HTTPResponse) {
 }
 
 func ProxyError(w http.ResponseWriter, err error) {
+	ProxyErrorCode(w, 526, err)
+}
+
+func ProxyErrorCode(w http.ResponseWriter, code int, err error) {
 	log.Println(err)
-	http.Error(w, err.Error(), 526)
+	http.Error(w, err.Error(), code)
 }
 
 func ProxyErrorf(w http.ResponseWriter, format string, args ...interface{}) {
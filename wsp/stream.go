@@ -0,0 +1,271 @@
+package wsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+var ErrStreamClosed = errors.New("stream closed")
+
+type ResetError struct {
+	Reason string
+}
+
+func (err *ResetError) Error() string {
+	return fmt.Sprintf("stream reset by peer : %s", err.Reason)
+}
+
+// Stream is one request carried by a Mux. The opener sends a header with the
+// Open frame, the peer answers with Reply, and both sides then exchange data
+// until each has sent End.
+type Stream struct {
+	id     uint32
+	mux    *Mux
+	flags  byte
+	header []byte
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock     sync.Mutex
+	cond     *sync.Cond
+	buffer   bytes.Buffer
+	reply    []byte
+	replied  bool
+	readEnd  bool
+	writeEnd bool
+	window   int
+	consumed int
+	err      error
+}
+
+func newStream(mux *Mux, id uint32, flags byte, header []byte) (stream *Stream) {
+	stream = new(Stream)
+	stream.id = id
+	stream.mux = mux
+	stream.flags = flags
+	stream.header = header
+	stream.window = StreamWindow
+	stream.cond = sync.NewCond(&stream.lock)
+	stream.ctx, stream.cancel = context.WithCancel(context.Background())
+	return
+}
+
+func (stream *Stream) ID() uint32 {
+	return stream.id
+}
+
+func (stream *Stream) Flags() byte {
+	return stream.flags
+}
+
+func (stream *Stream) Header() []byte {
+	return stream.header
+}
+
+// Context is canceled once the stream is closed, reset or its connection
+// lost.
+func (stream *Stream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *Stream) Reply(header []byte) error {
+	return stream.mux.writeFrame(&Frame{Type: FrameReply, StreamID: stream.id, Payload: header})
+}
+
+// ReadReply waits for the peer Reply header.
+func (stream *Stream) ReadReply() ([]byte, error) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	for !stream.replied && stream.err == nil {
+		stream.cond.Wait()
+	}
+	if stream.replied {
+		return stream.reply, nil
+	}
+	return nil, stream.err
+}
+
+func (stream *Stream) Read(p []byte) (n int, err error) {
+	stream.lock.Lock()
+	for stream.buffer.Len() == 0 && !stream.readEnd && stream.err == nil {
+		stream.cond.Wait()
+	}
+
+	if stream.buffer.Len() == 0 {
+		err = stream.err
+		if stream.readEnd {
+			err = io.EOF
+		}
+		stream.lock.Unlock()
+		return
+	}
+
+	n, _ = stream.buffer.Read(p)
+	stream.consumed += n
+
+	update := 0
+	if stream.consumed >= StreamWindow/2 && !stream.readEnd {
+		update = stream.consumed
+		stream.consumed = 0
+	}
+	stream.lock.Unlock()
+
+	if update > 0 {
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(update))
+		stream.mux.writeFrame(&Frame{Type: FrameWindow, StreamID: stream.id, Payload: payload})
+	}
+
+	return
+}
+
+// Write sends p as data frames, blocking while the peer window is exhausted.
+func (stream *Stream) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		stream.lock.Lock()
+		for stream.window == 0 && stream.err == nil && !stream.writeEnd {
+			stream.cond.Wait()
+		}
+		if stream.err != nil {
+			err = stream.err
+			stream.lock.Unlock()
+			return
+		}
+		if stream.writeEnd {
+			stream.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+
+		n := len(p)
+		if n > stream.window {
+			n = stream.window
+		}
+		if n > MaxFramePayload {
+			n = MaxFramePayload
+		}
+		stream.window -= n
+		stream.lock.Unlock()
+
+		err = stream.mux.writeFrame(&Frame{Type: FrameData, StreamID: stream.id, Payload: p[:n]})
+		if err != nil {
+			return
+		}
+
+		written += n
+		p = p[n:]
+	}
+
+	return
+}
+
+// CloseWrite tells the peer no more data will be written.
+func (stream *Stream) CloseWrite() error {
+	stream.lock.Lock()
+	if stream.writeEnd || stream.err != nil {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.writeEnd = true
+	finished := stream.readEnd
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	err := stream.mux.writeFrame(&Frame{Type: FrameEnd, StreamID: stream.id})
+	if finished {
+		stream.mux.remove(stream)
+	}
+	return err
+}
+
+// Close releases the stream, resetting it if either direction is unfinished.
+func (stream *Stream) Close() error {
+	stream.lock.Lock()
+	finished := stream.readEnd && stream.writeEnd
+	failed := stream.err != nil
+	if !finished && !failed {
+		stream.err = ErrStreamClosed
+		stream.cond.Broadcast()
+	}
+	stream.lock.Unlock()
+
+	stream.cancel()
+	stream.mux.remove(stream)
+	if finished || failed {
+		return nil
+	}
+	return stream.mux.writeFrame(&Frame{Type: FrameReset, StreamID: stream.id, Payload: []byte(ErrStreamClosed.Error())})
+}
+
+// Reset aborts the stream on both sides.
+func (stream *Stream) Reset(reason string) error {
+	stream.lock.Lock()
+	if stream.err != nil {
+		stream.lock.Unlock()
+		return nil
+	}
+	stream.err = fmt.Errorf("stream reset : %s", reason)
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	stream.cancel()
+	stream.mux.remove(stream)
+	return stream.mux.writeFrame(&Frame{Type: FrameReset, StreamID: stream.id, Payload: []byte(reason)})
+}
+
+func (stream *Stream) fail(err error) {
+	stream.lock.Lock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	stream.cancel()
+}
+
+func (stream *Stream) receiveReply(header []byte) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	stream.reply = header
+	stream.replied = true
+	stream.cond.Broadcast()
+}
+
+func (stream *Stream) receiveData(data []byte) {
+	stream.lock.Lock()
+	if stream.buffer.Len()+len(data) > StreamWindow {
+		stream.lock.Unlock()
+		stream.Reset("flow control window exceeded")
+		return
+	}
+	stream.buffer.Write(data)
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+}
+
+func (stream *Stream) receiveEnd() {
+	stream.lock.Lock()
+	stream.readEnd = true
+	finished := stream.writeEnd
+	stream.cond.Broadcast()
+	stream.lock.Unlock()
+
+	if finished {
+		stream.mux.remove(stream)
+	}
+}
+
+func (stream *Stream) receiveWindow(n int) {
+	stream.lock.Lock()
+	defer stream.lock.Unlock()
+
+	stream.window += n
+	stream.cond.Broadcast()
+}
@@ -0,0 +1,21 @@
+package wsp
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// LoadCertPool reads the PEM encoded certificates of a CA bundle.
+func LoadCertPool(path string) (pool *x509.CertPool, err error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bytes) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return
+}
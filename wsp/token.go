@@ -0,0 +1,75 @@
+package wsp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token is the credential of one client. It is signed with the server key
+// named Key and expires at the Expires unix time, or never when zero.
+type Token struct {
+	ID      string
+	Key     string
+	Expires int64
+}
+
+// Sign returns the token encoded as base64url(json).base64url(hmac-sha256).
+func (token *Token) Sign(secret string) (string, error) {
+	payload, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(secret, encoded)), nil
+}
+
+// ParseToken verifies a signed token against keys, indexed by key name.
+func ParseToken(signed string, keys map[string]string) (token *Token, err error) {
+	parts := strings.Split(signed, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload : %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature : %w", err)
+	}
+
+	token = new(Token)
+	if err = json.Unmarshal(payload, token); err != nil {
+		return nil, fmt.Errorf("malformed token payload : %w", err)
+	}
+
+	secret, ok := keys[token.Key]
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %q", token.Key)
+	}
+	if !hmac.Equal(signature, tokenMAC(secret, parts[0])) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	if token.ID == "" {
+		return nil, fmt.Errorf("token has no client id")
+	}
+	if token.Expires != 0 && time.Now().Unix() >= token.Expires {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	return
+}
+
+func tokenMAC(secret string, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
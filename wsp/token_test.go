@@ -0,0 +1,70 @@
+package wsp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseToken(t *testing.T) {
+	sign := func(token *Token, secret string) string {
+		signed, err := token.Sign(secret)
+		if err != nil {
+			t.Fatalf("unable to sign token : %s", err)
+		}
+		return signed
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	valid := sign(&Token{ID: "client", Key: "k1", Expires: future}, "first")
+	parts := strings.Split(valid, ".")
+	tampered := sign(&Token{ID: "other", Key: "k1", Expires: future}, "first")
+	tampered = strings.Split(tampered, ".")[0] + "." + parts[1]
+
+	current := map[string]string{"k1": "first"}
+	rotating := map[string]string{"k1": "first", "k2": "second"}
+	rotated := map[string]string{"k2": "second"}
+
+	tests := []struct {
+		name   string
+		signed string
+		keys   map[string]string
+		id     string
+		err    string
+	}{
+		{name: "valid", signed: valid, keys: current, id: "client"},
+		{name: "no expiry", signed: sign(&Token{ID: "client", Key: "k1"}, "first"), keys: current, id: "client"},
+		{name: "expired", signed: sign(&Token{ID: "client", Key: "k1", Expires: past}, "first"), keys: current, err: "expired"},
+		{name: "bad mac", signed: sign(&Token{ID: "client", Key: "k1"}, "wrong"), keys: current, err: "invalid token signature"},
+		{name: "tampered payload", signed: tampered, keys: current, err: "invalid token signature"},
+		{name: "unknown key", signed: sign(&Token{ID: "client", Key: "k3"}, "third"), keys: current, err: "unknown token key"},
+		{name: "old key while rotating", signed: valid, keys: rotating, id: "client"},
+		{name: "new key while rotating", signed: sign(&Token{ID: "client", Key: "k2"}, "second"), keys: rotating, id: "client"},
+		{name: "old key once rotated", signed: valid, keys: rotated, err: "unknown token key"},
+		{name: "new key reusing old name", signed: valid, keys: map[string]string{"k1": "second"}, err: "invalid token signature"},
+		{name: "no id", signed: sign(&Token{Key: "k1"}, "first"), keys: current, err: "no client id"},
+		{name: "no signature", signed: parts[0], keys: current, err: "malformed token"},
+		{name: "bad encoding", signed: "!!." + parts[1], keys: current, err: "malformed token payload"},
+		{name: "bad payload", signed: "bm90IGpzb24." + parts[1], keys: current, err: "malformed token payload"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := ParseToken(test.signed, test.keys)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, expected an error containing %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error : %s", err)
+			}
+			if token.ID != test.id {
+				t.Fatalf("got id %q, expected %q", token.ID, test.id)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package wsp
+
+import (
+	"os"
+	"time"
+)
+
+// WatchFile checks path every interval and sends its new modification time
+// whenever it changed.
+func WatchFile(path string, interval time.Duration) <-chan time.Time {
+	changed := make(chan time.Time)
+	go func() {
+		var modTime time.Time
+		if info, err := os.Stat(path); err == nil {
+			modTime = info.ModTime()
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			info, err := os.Stat(path)
+			if err != nil || info.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = info.ModTime()
+			changed <- modTime
+		}
+	}()
+	return changed
+}